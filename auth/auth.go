@@ -0,0 +1,117 @@
+package auth
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"strings"
+	"sync"
+)
+
+var htpasswdFileName string
+
+func init() {
+	flag.StringVar(
+		&htpasswdFileName,
+		"auth-file", "",
+		"htpasswd file with bcrypt hashed passwords of clients, "+
+			"no authentication if empty")
+}
+
+// Users allowed to use proxy. Nil *Users means authentication is disabled
+// and any client is allowed.
+type Users struct {
+	hashes map[string][]byte
+	// Compared for unknown users, so they take as long to check as known
+	// ones.
+	dummy []byte
+	// bcrypt is slow, so remember passwords already verified. Only
+	// SHA-256 of password is kept in memory.
+	lock     sync.RWMutex
+	verified map[string][sha256.Size]byte
+}
+
+// Load users from file set with -auth-file flag. Return nil if flag is
+// not set.
+func LoadUsers() (*Users, error) {
+	if htpasswdFileName == "" {
+		return nil, nil
+	}
+	return ReadHtpasswd(htpasswdFileName)
+}
+
+// Read htpasswd file. One user:hash per line, only bcrypt hashes are
+// supported. Empty lines and lines starting with # are skipped.
+func ReadHtpasswd(fileName string) (*Users, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var users *Users = &Users{
+		hashes:   make(map[string][]byte),
+		verified: make(map[string][sha256.Size]byte),
+	}
+	var reader *bufio.Scanner = bufio.NewScanner(file)
+	lineNum := 0
+	maxCost := bcrypt.MinCost
+	for reader.Scan() {
+		lineNum++
+		line := strings.TrimSpace(reader.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf(
+				"%v:%d: expected user:hash", fileName, lineNum)
+		}
+		hash := []byte(line[i+1:])
+		cost, err := bcrypt.Cost(hash)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"%v:%d: not a bcrypt hash: %v", fileName, lineNum, err)
+		}
+		if cost > maxCost {
+			maxCost = cost
+		}
+		users.hashes[line[:i]] = hash
+	}
+	if err = reader.Err(); err != nil {
+		return nil, err
+	}
+	users.dummy, err = bcrypt.GenerateFromPassword(nil, maxCost)
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// Return true if user exists and password is correct.
+func (u *Users) Check(user, password string) bool {
+	hash, ok := u.hashes[user]
+	if !ok {
+		bcrypt.CompareHashAndPassword(u.dummy, []byte(password))
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(password))
+	u.lock.RLock()
+	verified, ok := u.verified[user]
+	u.lock.RUnlock()
+	if ok && verified == sum {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	u.lock.Lock()
+	u.verified[user] = sum
+	u.lock.Unlock()
+	return true
+}
@@ -0,0 +1,101 @@
+package auth
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "dynproxy-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestUsersCheck(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := writeTempFile(t, "# comment\n\nalice:"+string(hash)+"\n")
+	defer os.Remove(fileName)
+
+	users, err := ReadHtpasswd(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if !users.Check("alice", "secret") {
+			t.Fatal("valid password rejected")
+		}
+		if users.Check("alice", "wrong") {
+			t.Fatal("wrong password accepted")
+		}
+	}
+	if users.Check("bob", "secret") {
+		t.Fatal("unknown user accepted")
+	}
+	// unknown users are compared with hash as slow as known ones
+	if cost, err := bcrypt.Cost(users.dummy); err != nil ||
+		cost != bcrypt.MinCost {
+		t.Fatalf("unexpected dummy hash cost %v: %v", cost, err)
+	}
+}
+
+func TestReadHtpasswdInvalid(t *testing.T) {
+	for _, content := range []string{"alice\n", "alice:{SHA}abc\n"} {
+		fileName := writeTempFile(t, content)
+		_, err := ReadHtpasswd(fileName)
+		os.Remove(fileName)
+		if err == nil {
+			t.Fatalf("%q: expected error", content)
+		}
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	fileName := writeTempFile(t, `{
+		"alice": {"hosts": ["example.com", "*.example.com"], "ports": [443]},
+		"*": {"pools": ["vendor=a"]}
+	}`)
+	defer os.Remove(fileName)
+
+	policies, err := ReadPolicies(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, ok := policies.Lookup("alice")
+	if !ok || alice.Override {
+		t.Fatalf("alice = %v", alice)
+	}
+	cases := map[string]bool{
+		"example.com:443":      true,
+		"WWW.Example.com.:443": true,
+		"example.com:80":       false,
+		"badexample.com:443":   false,
+		"example.com.evil:443": false,
+		"not a target":         false,
+	}
+	for target, allowed := range cases {
+		if alice.AllowTarget(target) != allowed {
+			t.Fatalf("%v: expected %v", target, allowed)
+		}
+	}
+
+	bob, ok := policies.Lookup("bob")
+	if !ok || len(bob.Pools) != 1 || !bob.AllowTarget("any.host:25") {
+		t.Fatalf("bob = %v", bob)
+	}
+
+	var none *Policies
+	if p, ok := none.Lookup("bob"); !ok || !p.Override {
+		t.Fatal("nil policies must allow everything")
+	}
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Name of policy for users without own policy. If authentication is
+// disabled, it applies to all clients.
+const DefaultPolicyName = "*"
+
+var policyFileName string
+
+func init() {
+	flag.StringVar(
+		&policyFileName,
+		"acl-file", "",
+		"JSON file with access policy per user, everything is allowed "+
+			"if empty")
+}
+
+// What user is allowed to do
+type Policy struct {
+	// Patterns of destination hosts, like "example.com" or
+	// "*.example.com". Any host is allowed if empty.
+	Hosts []string `json:"hosts"`
+	// Destination ports. Any port is allowed if empty.
+	Ports []int `json:"ports"`
+	// Tags of proxies user may use. Any proxy if empty.
+	Pools []string `json:"pools"`
+	// User may choose proxy with X-Dynproxy-Proxy header
+	Override bool `json:"override"`
+	// User may change proxies with control API
+	Admin bool `json:"admin"`
+}
+
+// Policy allowing everything, used when no policy file is given
+var allowAll *Policy = &Policy{Override: true}
+
+// Policies by user name. Nil *Policies allows everything to everyone.
+type Policies struct {
+	users map[string]*Policy
+}
+
+// Load policies from file set with -acl-file flag. Return nil if flag is
+// not set.
+func LoadPolicies() (*Policies, error) {
+	if policyFileName == "" {
+		return nil, nil
+	}
+	return ReadPolicies(policyFileName)
+}
+
+// Read policies from JSON file with object of user names to policies.
+func ReadPolicies(fileName string) (*Policies, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var users map[string]*Policy
+	if err = json.NewDecoder(file).Decode(&users); err != nil {
+		return nil, fmt.Errorf("%v: %v", fileName, err)
+	}
+	for user, policy := range users {
+		if policy == nil {
+			return nil, fmt.Errorf("%v: empty policy of %v", fileName, user)
+		}
+		for _, pattern := range policy.Hosts {
+			if _, err = path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf(
+					"%v: bad host pattern %q of %v", fileName, pattern, user)
+			}
+		}
+	}
+	return &Policies{users: users}, nil
+}
+
+// Return policy of user, or default policy if user has none. Return false
+// if there is no policy for user at all and user is not allowed to do
+// anything.
+func (ps *Policies) Lookup(user string) (*Policy, bool) {
+	if ps == nil {
+		return allowAll, true
+	}
+	if policy, ok := ps.users[user]; ok {
+		return policy, true
+	}
+	policy, ok := ps.users[DefaultPolicyName]
+	return policy, ok
+}
+
+// Return true if user may connect to target in host:port form.
+func (p *Policy) AllowTarget(target string) bool {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	return p.allowHost(host) && p.allowPort(port)
+}
+
+func (p *Policy) allowHost(host string) bool {
+	if len(p.Hosts) == 0 {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.Hosts {
+		if ok, _ := path.Match(strings.ToLower(pattern), host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Policy) allowPort(port int) bool {
+	if len(p.Ports) == 0 {
+		return true
+	}
+	for _, allowed := range p.Ports {
+		if allowed == port {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/base64"
+	"github.com/olomix/dynproxy/auth"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const SESSION_HEADER = "X-Dynproxy-Session"
+const POOL_HEADER = "X-Dynproxy-Pool"
+
+// Client may pass options to dynproxy in proxy username as query, like
+// "user?session=abc". Split username into name and options.
+func parseUsername(username string) (string, url.Values) {
+	i := strings.IndexByte(username, '?')
+	if i == -1 {
+		return username, url.Values{}
+	}
+	opts, err := url.ParseQuery(username[i+1:])
+	if err != nil {
+		opts = url.Values{}
+	}
+	return username[:i], opts
+}
+
+// Return credentials from Proxy-Authorization header with Basic scheme
+func proxyBasicAuth(req *http.Request) (string, string, bool) {
+	auth := req.Header.Get("Proxy-Authorization")
+	const prefix = "Basic "
+	if len(auth) < len(prefix) ||
+		!strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	c, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	cs := string(c)
+	i := strings.IndexByte(cs, ':')
+	if i < 0 {
+		return "", "", false
+	}
+	return cs[:i], cs[i+1:], true
+}
+
+// Check credentials of client from Proxy-Authorization header and return
+// name of authenticated user. If authentication is disabled, any client
+// is allowed and empty name is returned.
+func authenticateRequest(req *http.Request) (string, bool) {
+	if users == nil {
+		return "", true
+	}
+	username, password, ok := proxyBasicAuth(req)
+	if !ok {
+		return "", false
+	}
+	name, _ := parseUsername(username)
+	return name, users.Check(name, password)
+}
+
+// Options of client request taken from dynproxy headers and proxy
+// username. Headers win over username options. Headers and proxy
+// authorization with options are removed from request, so they are not
+// sent upstream.
+type clientOptions struct {
+	session string
+	// Tags of proxies to serve request, any proxy if empty
+	pool []string
+}
+
+func requestOptions(req *http.Request) clientOptions {
+	var opts clientOptions
+	if username, _, ok := proxyBasicAuth(req); ok {
+		if strings.IndexByte(username, '?') != -1 {
+			req.Header.Del("Proxy-Authorization")
+		}
+		opts = usernameOptions(username)
+	}
+	if session := req.Header.Get(SESSION_HEADER); session != "" {
+		opts.session = session
+	}
+	req.Header.Del(SESSION_HEADER)
+	if pools, ok := req.Header[POOL_HEADER]; ok {
+		opts.pool = nil
+		for _, pool := range pools {
+			opts.pool = append(opts.pool, splitPool(pool)...)
+		}
+	}
+	req.Header.Del(POOL_HEADER)
+	return opts
+}
+
+func usernameOptions(username string) clientOptions {
+	_, values := parseUsername(username)
+	var opts clientOptions = clientOptions{session: values.Get("session")}
+	for _, pool := range values["pool"] {
+		opts.pool = append(opts.pool, splitPool(pool)...)
+	}
+	return opts
+}
+
+// Split comma separated list of tags
+func splitPool(pool string) []string {
+	var tags []string
+	for _, tag := range strings.Split(pool, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Pool of proxies to serve client. Client may narrow pool allowed by its
+// policy, but not extend it. Return false if client asked for pool it is
+// not allowed to use.
+func restrictPool(policy *auth.Policy, pool []string) ([]string, bool) {
+	if len(pool) == 0 {
+		return policy.Pools, true
+	}
+	if len(policy.Pools) == 0 {
+		return pool, true
+	}
+	for _, tag := range pool {
+		allowed := false
+		for _, t := range policy.Pools {
+			if t == tag {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return nil, false
+		}
+	}
+	return pool, true
+}
@@ -0,0 +1,390 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/olomix/dynproxy/proxy_cache"
+	"github.com/olomix/dynproxy/stats"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// JSON API of control server. Field names of replies are part of API and
+// must not change.
+//
+//	GET    /api/proxies?state=good|bad&tag=T  list proxies
+//	POST   /api/proxies                       add proxy
+//	GET    /api/proxies/{addr}                one proxy
+//	DELETE /api/proxies/{addr}                remove proxy
+//	POST   /api/proxies/{addr}/check          check proxy now
+//	GET    /api/requests                      active requests
+//	GET    /api/stats                         counters
+//	GET    /api/traffic                       traffic by proxy and client
+//
+// Calls changing proxies need Basic credentials of -auth-file user with
+// admin policy. If authentication is disabled, they are allowed from
+// loopback only. Changes from browsers, which send Origin header, are
+// rejected, so web pages can't change proxies on behalf of user.
+
+const apiPrefix = "/api/"
+
+type apiProxy struct {
+	Address     string     `json:"address"`
+	Scheme      string     `json:"scheme"`
+	Name        string     `json:"name"`
+	Good        bool       `json:"good"`
+	FailCounter uint       `json:"fail_counter"`
+	LastCheck   *time.Time `json:"last_check"` // null if never checked
+	Anonymity   string     `json:"anonymity"`
+	Tags        []string   `json:"tags"`
+	Latency     apiLatency `json:"latency"`
+}
+
+// Timings in milliseconds, 0 if not measured
+type apiTiming struct {
+	Connect   float64 `json:"connect_ms"`
+	FirstByte float64 `json:"first_byte_ms"`
+	Total     float64 `json:"total_ms"`
+}
+
+// Average timings and last timings of checks and requests, oldest first
+type apiLatency struct {
+	apiTiming
+	History []apiTiming `json:"history"`
+}
+
+// Body of POST /api/proxies
+type apiNewProxy struct {
+	Address  string   `json:"address"`
+	Scheme   string   `json:"scheme"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Tags     []string `json:"tags"`
+}
+
+type apiRequest struct {
+	ID                   int    `json:"id"`
+	URL                  string `json:"url"`
+	Client               string `json:"client"`
+	User                 string `json:"user"`
+	Proxy                string `json:"proxy"`
+	ClientHandlerRunning bool   `json:"client_handler_running"`
+	ProxyHandlerRunning  bool   `json:"proxy_handler_running"`
+	ActiveSeconds        int    `json:"active_seconds"`
+	Attempts             int    `json:"attempts"`
+}
+
+type apiStats struct {
+	Proxies        int            `json:"proxies"`
+	GoodProxies    int            `json:"good_proxies"`
+	GoodByTag      map[string]int `json:"good_proxies_by_tag"`
+	ActiveRequests int            `json:"active_requests"`
+	ClientProxy    uint64         `json:"client_proxy_goroutines"`
+	ProxyClient    uint64         `json:"proxy_client_goroutines"`
+	RunningChecks  uint64         `json:"running_checks"`
+}
+
+// Traffic counters of proxy or client
+type apiTraffic struct {
+	Requests uint64            `json:"requests"`
+	BytesIn  uint64            `json:"bytes_in"`  // from proxy to client
+	BytesOut uint64            `json:"bytes_out"` // from client to proxy
+	Status   map[string]uint64 `json:"status"`    // by class like "2xx"
+	Errors   map[string]uint64 `json:"errors"`    // by error type
+}
+
+type apiTrafficStats struct {
+	Proxies map[string]apiTraffic `json:"proxies"` // by proxy name
+	Clients map[string]apiTraffic `json:"clients"` // by user or IP
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func (c *HttpController) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" && !c.authorizeChange(w, r) {
+		return
+	}
+	path := strings.TrimPrefix(r.URL.EscapedPath(), apiPrefix)
+	switch {
+	case path == "proxies":
+		switch r.Method {
+		case "GET":
+			c.listProxies(w, r)
+		case "POST":
+			c.addProxy(w, r)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	case strings.HasPrefix(path, "proxies/"):
+		addr, check := strings.TrimPrefix(path, "proxies/"), false
+		if strings.HasSuffix(addr, "/check") {
+			addr, check = strings.TrimSuffix(addr, "/check"), true
+		}
+		addr, err := url.PathUnescape(addr)
+		if err != nil || addr == "" || strings.Contains(addr, "/") {
+			writeAPIError(w, http.StatusNotFound, "not found")
+			return
+		}
+		switch {
+		case check && r.Method == "POST":
+			c.checkProxy(w, addr)
+		case check:
+			methodNotAllowed(w, "POST")
+		case r.Method == "GET":
+			c.getProxy(w, addr)
+		case r.Method == "DELETE":
+			c.removeProxy(w, addr)
+		default:
+			methodNotAllowed(w, "GET, DELETE")
+		}
+	case path == "requests":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		c.listRequests(w)
+	case path == "stats":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		c.stats(w)
+	case path == "traffic":
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		writeJSON(w, http.StatusOK, apiTrafficStats{
+			Proxies: trafficJSON(c.grs.ProxyTraffic()),
+			Clients: trafficJSON(c.grs.ClientTraffic()),
+		})
+	default:
+		writeAPIError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// Return true if client may change proxies, reply with error otherwise.
+func (c *HttpController) authorizeChange(
+	w http.ResponseWriter, r *http.Request,
+) bool {
+	if r.Header.Get("Origin") != "" {
+		writeAPIError(
+			w, http.StatusForbidden, "changes from browsers are not allowed")
+		return false
+	}
+	if c.users == nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil && ip.IsLoopback() {
+			return true
+		}
+		writeAPIError(
+			w, http.StatusForbidden,
+			"changes are allowed from loopback only without -auth-file")
+		return false
+	}
+	user, password, ok := r.BasicAuth()
+	if !ok || !c.users.Check(user, password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dynproxy"`)
+		writeAPIError(w, http.StatusUnauthorized, "authentication required")
+		return false
+	}
+	if policy, ok := c.policies.Lookup(user); !ok || !policy.Admin {
+		writeAPIError(w, http.StatusForbidden, "user is not admin")
+		return false
+	}
+	return true
+}
+
+func (c *HttpController) listProxies(w http.ResponseWriter, r *http.Request) {
+	var (
+		query url.Values = r.URL.Query()
+		state string     = query.Get("state")
+		tags  []string   = query["tag"]
+	)
+	if state != "" && state != "good" && state != "bad" {
+		writeAPIError(
+			w, http.StatusBadRequest, "state must be good or bad")
+		return
+	}
+
+	var proxies []apiProxy = make([]apiProxy, 0)
+	for _, proxy := range c.pCache.Proxies() {
+		if !proxy.InPool(tags) {
+			continue
+		}
+		p := c.proxyJSON(&proxy)
+		if state == "good" && !p.Good || state == "bad" && p.Good {
+			continue
+		}
+		proxies = append(proxies, p)
+	}
+	writeJSON(w, http.StatusOK, proxies)
+}
+
+func (c *HttpController) getProxy(w http.ResponseWriter, addr string) {
+	proxy, ok := c.pCache.LookupProxy(addr)
+	if !ok {
+		writeAPIError(w, http.StatusNotFound, "unknown proxy")
+		return
+	}
+	writeJSON(w, http.StatusOK, c.proxyJSON(&proxy))
+}
+
+func (c *HttpController) addProxy(w http.ResponseWriter, r *http.Request) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/json" {
+		writeAPIError(
+			w, http.StatusUnsupportedMediaType,
+			"Content-Type must be application/json")
+		return
+	}
+	var in apiNewProxy
+	if err := json.NewDecoder(r.Body).Decode(&in); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	proxy, err := proxy_cache.NewProxy(
+		in.Address, in.Scheme, in.Username, in.Password, in.Tags)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if !c.pCache.AddProxy(proxy) {
+		writeAPIError(w, http.StatusConflict, "proxy exists")
+		return
+	}
+	if added, ok := c.pCache.LookupProxy(proxy.Addr); ok {
+		proxy = added
+	}
+	writeJSON(w, http.StatusCreated, c.proxyJSON(&proxy))
+}
+
+func (c *HttpController) removeProxy(w http.ResponseWriter, addr string) {
+	if !c.pCache.RemoveProxy(addr) {
+		writeAPIError(w, http.StatusNotFound, "unknown proxy")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *HttpController) checkProxy(w http.ResponseWriter, addr string) {
+	if !c.pCache.CheckNow(addr) {
+		writeAPIError(w, http.StatusNotFound, "unknown proxy")
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (c *HttpController) listRequests(w http.ResponseWriter) {
+	var requests []apiRequest = make([]apiRequest, 0)
+	for _, r := range c.grs.ActiveRequests() {
+		requests = append(requests, apiRequest{
+			ID:                   r.Idx,
+			URL:                  r.URL,
+			Client:               r.Client,
+			User:                 r.User,
+			Proxy:                r.Proxy,
+			ClientHandlerRunning: r.ClientHandlerRunning,
+			ProxyHandlerRunning:  r.ProxyHandlerRunning,
+			ActiveSeconds:        r.ActiveSeconds,
+			Attempts:             r.Attempts,
+		})
+	}
+	writeJSON(w, http.StatusOK, requests)
+}
+
+func (c *HttpController) stats(w http.ResponseWriter) {
+	var stats proxy_cache.CacheStats = c.pCache.Stats()
+	writeJSON(w, http.StatusOK, apiStats{
+		Proxies:        stats.Proxies,
+		GoodProxies:    stats.Good,
+		GoodByTag:      stats.Pools,
+		ActiveRequests: len(c.grs.ActiveRequests()),
+		ClientProxy:    c.grs.GetClientProxy(),
+		ProxyClient:    c.grs.GetProxyClient(),
+		RunningChecks:  c.grs.GetCheckProxy(),
+	})
+}
+
+func (c *HttpController) proxyJSON(proxy *proxy_cache.Proxy) apiProxy {
+	var p apiProxy = apiProxy{
+		Address:     proxy.Addr,
+		Scheme:      proxy.Scheme,
+		Name:        proxy.Name(),
+		Good:        proxy.FailCounter() == 0,
+		FailCounter: proxy.FailCounter(),
+		Anonymity:   proxy.Anonymity,
+		Tags:        proxy.Tags,
+		Latency: apiLatency{
+			apiTiming: timingJSON(proxy.Latency.Average),
+			History: make(
+				[]apiTiming, 0, len(proxy.Latency.History)),
+		},
+	}
+	for _, t := range proxy.Latency.History {
+		p.Latency.History = append(p.Latency.History, timingJSON(t))
+	}
+	if p.Tags == nil {
+		p.Tags = []string{}
+	}
+	if lastCheck := proxy.LastCheck(); !lastCheck.IsZero() {
+		p.LastCheck = &lastCheck
+	}
+	return p
+}
+
+func trafficJSON(traffic map[string]stats.Traffic) map[string]apiTraffic {
+	var result map[string]apiTraffic = make(map[string]apiTraffic)
+	for key, t := range traffic {
+		var a apiTraffic = apiTraffic{
+			Requests: t.Requests,
+			BytesIn:  t.BytesIn,
+			BytesOut: t.BytesOut,
+			Status:   t.Status,
+			Errors:   t.Errors,
+		}
+		if a.Status == nil {
+			a.Status = map[string]uint64{}
+		}
+		if a.Errors == nil {
+			a.Errors = map[string]uint64{}
+		}
+		result[key] = a
+	}
+	return result
+}
+
+func timingJSON(t proxy_cache.Timing) apiTiming {
+	return apiTiming{
+		Connect:   msFloat(t.Connect),
+		FirstByte: msFloat(t.FirstByte),
+		Total:     msFloat(t.Total),
+	}
+}
+
+func msFloat(d time.Duration) float64 {
+	return d.Seconds() * 1000
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeAPIError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, apiError{message})
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeAPIError(
+		w, http.StatusMethodNotAllowed,
+		fmt.Sprintf("method must be %v", allow))
+}
@@ -0,0 +1,332 @@
+package http
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/olomix/dynproxy/auth"
+	"github.com/olomix/dynproxy/proxy_cache"
+	"github.com/olomix/dynproxy/stats"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Cache with proxies in memory. Methods not used by API panic.
+type fakeCache struct {
+	proxy_cache.ProxyCache
+	proxies map[string]proxy_cache.Proxy
+	checked []string
+}
+
+// Cache with good proxies parsed from lines
+func newFakeCache(lines ...string) *fakeCache {
+	c := &fakeCache{proxies: make(map[string]proxy_cache.Proxy)}
+	for _, line := range lines {
+		p, err := proxy_cache.ParseProxyLine(line)
+		if err != nil {
+			panic(err)
+		}
+		c.proxies[p.Addr] = p
+	}
+	return c
+}
+
+// Make proxy bad. Fail counter is not exported, so proxy is decoded as if
+// it was read from save file.
+func (c *fakeCache) setBad(addr string) {
+	p := c.proxies[addr]
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	for _, v := range []interface{}{p.Addr, time.Time{}, uint(1), p.Scheme} {
+		if err := encoder.Encode(v); err != nil {
+			panic(err)
+		}
+	}
+	if err := p.GobDecode(buf.Bytes()); err != nil {
+		panic(err)
+	}
+	c.proxies[addr] = p
+}
+
+func (c *fakeCache) Proxies() []proxy_cache.Proxy {
+	var proxies []proxy_cache.Proxy
+	for _, p := range c.proxies {
+		proxies = append(proxies, p)
+	}
+	return proxies
+}
+
+func (c *fakeCache) LookupProxy(addr string) (proxy_cache.Proxy, bool) {
+	p, ok := c.proxies[addr]
+	return p, ok
+}
+
+func (c *fakeCache) AddProxy(p proxy_cache.Proxy) bool {
+	if _, ok := c.proxies[p.Addr]; ok {
+		return false
+	}
+	c.proxies[p.Addr] = p
+	return true
+}
+
+func (c *fakeCache) RemoveProxy(addr string) bool {
+	_, ok := c.proxies[addr]
+	delete(c.proxies, addr)
+	return ok
+}
+
+func (c *fakeCache) CheckNow(addr string) bool {
+	c.checked = append(c.checked, addr)
+	_, ok := c.proxies[addr]
+	return ok
+}
+
+func (c *fakeCache) Stats() proxy_cache.CacheStats {
+	var good int
+	for _, p := range c.proxies {
+		if p.FailCounter() == 0 {
+			good++
+		}
+	}
+	return proxy_cache.CacheStats{
+		Proxies: len(c.proxies), Good: good,
+		Pools: map[string]int{"vendor=a": 1}}
+}
+
+func doAPI(
+	t *testing.T, c *HttpController, method, path, body string,
+	status int, out interface{},
+) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.RemoteAddr = "127.0.0.1:5000"
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, req)
+	if w.Code != status {
+		t.Fatalf("%v %v: status %v, body %v", method, path, w.Code, w.Body)
+	}
+	if out != nil {
+		if err := json.Unmarshal(w.Body.Bytes(), out); err != nil {
+			t.Fatalf("%v %v: %v", method, path, err)
+		}
+	}
+}
+
+func TestAPIProxies(t *testing.T) {
+	cache := newFakeCache("1.1.1.1:80 vendor=a", "socks5://2.2.2.2:1080")
+	cache.setBad("2.2.2.2:1080")
+	c := &HttpController{grs: stats.New(), pCache: cache}
+
+	var proxies []map[string]interface{}
+	doAPI(
+		t, c, "GET", "/api/proxies?state=good&tag=vendor=a", "",
+		http.StatusOK, &proxies)
+	if len(proxies) != 1 || proxies[0]["address"] != "1.1.1.1:80" ||
+		proxies[0]["good"] != true || proxies[0]["last_check"] != nil {
+		t.Fatalf("unexpected proxies %v", proxies)
+	}
+	doAPI(
+		t, c, "GET", "/api/proxies?state=bad", "", http.StatusOK, &proxies)
+	if len(proxies) != 1 || proxies[0]["name"] != "socks5://2.2.2.2:1080" {
+		t.Fatalf("unexpected bad proxies %v", proxies)
+	}
+	doAPI(
+		t, c, "GET", "/api/proxies?state=ugly", "",
+		http.StatusBadRequest, nil)
+
+	var proxy map[string]interface{}
+	doAPI(
+		t, c, "POST", "/api/proxies",
+		`{"address": "3.3.3.3:1080", "scheme": "socks5", "tags": ["b"]}`,
+		http.StatusCreated, &proxy)
+	if proxy["scheme"] != "socks5" {
+		t.Fatalf("unexpected added proxy %v", proxy)
+	}
+	doAPI(
+		t, c, "POST", "/api/proxies", `{"address": "3.3.3.3:1080"}`,
+		http.StatusConflict, nil)
+	doAPI(
+		t, c, "POST", "/api/proxies", `{"address": "3.3.3.3"}`,
+		http.StatusBadRequest, nil)
+	// form posted by web page is not accepted
+	req := httptest.NewRequest(
+		"POST", "/api/proxies", strings.NewReader(`{"address": "4.4.4.4:80"}`))
+	req.RemoteAddr = "127.0.0.1:5000"
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	c.ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("add proxy as text: %v", w.Code)
+	}
+
+	doAPI(
+		t, c, "GET", "/api/proxies/3.3.3.3:1080", "", http.StatusOK, &proxy)
+	doAPI(
+		t, c, "POST", "/api/proxies/3.3.3.3:1080/check", "",
+		http.StatusAccepted, nil)
+	doAPI(
+		t, c, "DELETE", "/api/proxies/3.3.3.3%3A1080", "",
+		http.StatusNoContent, nil)
+	doAPI(
+		t, c, "DELETE", "/api/proxies/3.3.3.3:1080", "",
+		http.StatusNotFound, nil)
+	doAPI(
+		t, c, "PUT", "/api/proxies", "", http.StatusMethodNotAllowed, nil)
+	if len(cache.checked) != 1 || cache.checked[0] != "3.3.3.3:1080" {
+		t.Fatalf("unexpected checks %v", cache.checked)
+	}
+}
+
+func TestAPILatency(t *testing.T) {
+	cache := newFakeCache("1.1.1.1:80")
+	p := cache.proxies["1.1.1.1:80"]
+	p.Latency = proxy_cache.LatencyStats{
+		Average: proxy_cache.Timing{FirstByte: 20 * time.Millisecond},
+		History: []proxy_cache.Timing{
+			{Connect: 5 * time.Millisecond, FirstByte: 10 * time.Millisecond},
+			{FirstByte: 30 * time.Millisecond, Total: 40 * time.Millisecond},
+		},
+	}
+	cache.proxies[p.Addr] = p
+	c := &HttpController{grs: stats.New(), pCache: cache}
+
+	var proxy struct {
+		Latency struct {
+			FirstByte float64 `json:"first_byte_ms"`
+			History   []map[string]float64
+		}
+	}
+	doAPI(t, c, "GET", "/api/proxies/1.1.1.1:80", "", http.StatusOK, &proxy)
+	history := proxy.Latency.History
+	if proxy.Latency.FirstByte != 20 || len(history) != 2 ||
+		history[0]["connect_ms"] != 5 || history[1]["total_ms"] != 40 {
+		t.Fatalf("unexpected latency %+v", proxy.Latency)
+	}
+}
+
+func TestAPIAuthorization(t *testing.T) {
+	c := &HttpController{grs: stats.New(), pCache: newFakeCache("1.1.1.1:80")}
+	var origin string
+	serve := func(method, remote, user, password string) int {
+		req := httptest.NewRequest(method, "/api/proxies/1.1.1.1:80", nil)
+		req.RemoteAddr = remote
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		w := httptest.NewRecorder()
+		c.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// without users only loopback may change proxies
+	code := serve("DELETE", "10.0.0.1:5000", "", "")
+	if code != http.StatusForbidden {
+		t.Fatalf("remote change without users: %v", code)
+	}
+	if code = serve("GET", "10.0.0.1:5000", "", ""); code != http.StatusOK {
+		t.Fatalf("remote read: %v", code)
+	}
+	// web page in local browser can't change proxies
+	origin = "http://evil.example.com"
+	code = serve("DELETE", "127.0.0.1:5000", "", "")
+	if code != http.StatusForbidden {
+		t.Fatalf("change from browser: %v", code)
+	}
+	origin = ""
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "dynproxy-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("alice:" + string(hash) + "\nbob:" + string(hash) + "\n")
+	f.Close()
+	if c.users, err = auth.ReadHtpasswd(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	f, err = ioutil.TempFile("", "dynproxy-acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`{"alice": {"admin": true}, "*": {}}`)
+	f.Close()
+	if c.policies, err = auth.ReadPolicies(f.Name()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, creds := range [][2]string{{"", ""}, {"alice", "wrong"}} {
+		code = serve("DELETE", "127.0.0.1:5000", creds[0], creds[1])
+		if code != http.StatusUnauthorized {
+			t.Fatalf("change with credentials %v: %v", creds, code)
+		}
+	}
+	// proxy clients are not admins
+	code = serve("DELETE", "127.0.0.1:5000", "bob", "secret")
+	if code != http.StatusForbidden {
+		t.Fatalf("change by user: %v", code)
+	}
+	code = serve("DELETE", "10.0.0.1:5000", "alice", "secret")
+	if code != http.StatusNoContent {
+		t.Fatalf("change by admin: %v", code)
+	}
+}
+
+func TestAPIStats(t *testing.T) {
+	grs := stats.New()
+	idx := grs.NewRequest("127.0.0.1:5000")
+	grs.SetUrl(idx, "http://example.com/")
+	c := &HttpController{grs: grs, pCache: newFakeCache("1.1.1.1:80")}
+
+	var requests []map[string]interface{}
+	doAPI(t, c, "GET", "/api/requests", "", http.StatusOK, &requests)
+	if len(requests) != 1 || requests[0]["url"] != "http://example.com/" {
+		t.Fatalf("unexpected requests %v", requests)
+	}
+
+	var st map[string]interface{}
+	doAPI(t, c, "GET", "/api/stats", "", http.StatusOK, &st)
+	if st["proxies"] != 1.0 || st["active_requests"] != 1.0 {
+		t.Fatalf("unexpected stats %v", st)
+	}
+	doAPI(t, c, "GET", "/api/nothing", "", http.StatusNotFound, nil)
+}
+
+func TestAPITraffic(t *testing.T) {
+	grs := stats.New()
+	grs.AddProxyTraffic("1.1.1.1:80", stats.RequestTraffic(100, 10, 200, ""))
+	grs.AddClientTraffic("user", stats.RequestTraffic(0, 0, 0, "denied"))
+	c := &HttpController{grs: grs, pCache: newFakeCache()}
+
+	var traffic struct {
+		Proxies map[string]map[string]interface{}
+		Clients map[string]map[string]interface{}
+	}
+	doAPI(t, c, "GET", "/api/traffic", "", http.StatusOK, &traffic)
+	proxy := traffic.Proxies["1.1.1.1:80"]
+	if proxy["requests"] != 1.0 || proxy["bytes_in"] != 100.0 ||
+		proxy["status"].(map[string]interface{})["2xx"] != 1.0 {
+		t.Fatalf("unexpected proxy traffic %v", proxy)
+	}
+	client := traffic.Clients["user"]
+	if client["errors"].(map[string]interface{})["denied"] != 1.0 ||
+		len(client["status"].(map[string]interface{})) != 0 {
+		t.Fatalf("unexpected client traffic %v", client)
+	}
+	doAPI(t, c, "POST", "/api/traffic", "", http.StatusMethodNotAllowed, nil)
+}
@@ -2,9 +2,16 @@ package http
 
 import (
 	"flag"
+	"fmt"
+	"github.com/olomix/dynproxy/auth"
+	"github.com/olomix/dynproxy/log"
+	"github.com/olomix/dynproxy/metrics"
+	"github.com/olomix/dynproxy/proxy_cache"
 	"github.com/olomix/dynproxy/stats"
 	"html/template"
 	"net/http"
+	"strings"
+	"time"
 )
 
 var controlAddress string
@@ -19,35 +26,79 @@ func init() {
 }
 
 type HttpController struct {
-	grs  *stats.GoRoutineStats
-	tmpl *template.Template
+	grs      *stats.GoRoutineStats
+	pCache   proxy_cache.ProxyCache
+	users    *auth.Users    // nil if authentication is disabled
+	policies *auth.Policies // admins among users
+	tmpl     *template.Template
 }
 
-func ListenAndServe(grs *stats.GoRoutineStats) {
+// Start control server in background. Returned server may be shut down.
+// Users with admin policy are allowed to change proxies through API.
+func ListenAndServe(
+	grs *stats.GoRoutineStats, pCache proxy_cache.ProxyCache,
+	users *auth.Users, policies *auth.Policies,
+) *http.Server {
 	var controller *HttpController = new(HttpController)
 	controller.grs = grs
+	controller.pCache = pCache
+	controller.users = users
+	controller.policies = policies
 	var err error
-	controller.tmpl, err = template.New("StatisticsTmpl").Parse(tmpl)
+	controller.tmpl, err = template.New("StatisticsTmpl").
+		Funcs(template.FuncMap{"ms": milliseconds}).
+		Parse(tmpl)
 	if err != nil {
 		panic(err)
 	}
-	go http.ListenAndServe(controlAddress, controller)
+	registerGauges(grs, pCache)
+	var server *http.Server = &http.Server{
+		Addr: controlAddress, Handler: controller}
+	go func() {
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Errorf("Control server failed: %v", err)
+		}
+	}()
+	return server
 }
 
 func (c *HttpController) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, apiPrefix) {
+		c.serveAPI(w, r)
+		return
+	}
+	if r.URL.Path == metricsPath {
+		metrics.Handler().ServeHTTP(w, r)
+		return
+	}
 	c.tmpl.Execute(w, struct {
 		ClientProxyNum uint64
 		ProxyClientNum uint64
 		CheckProxyNum  uint64
 		Requests       []stats.ActiveRequest
+		Proxies        []proxy_cache.Proxy
+		ProxyTraffic   map[string]stats.Traffic
+		ClientTraffic  map[string]stats.Traffic
 	}{
 		c.grs.GetClientProxy(),
 		c.grs.GetProxyClient(),
 		c.grs.GetCheckProxy(),
 		c.grs.ActiveRequests(),
+		c.pCache.Proxies(),
+		c.grs.ProxyTraffic(),
+		c.grs.ClientTraffic(),
 	})
 }
 
+// Format duration as milliseconds, empty if not measured
+func milliseconds(d time.Duration) string {
+	if d <= 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.1f", d.Seconds()*1000)
+}
+
 const tmpl = `
 <html>
 <body>
@@ -62,20 +113,92 @@ checkProxyNum: {{.CheckProxyNum}} <br />
   <th>Idx</th>
   <th>URL</th>
   <th>Cleint Addr</th>
+  <th>User</th>
   <th>Proxy Addr</th>
   <th>Client handler running</th>
   <th>Proxy handler running</th>
   <th>Time</th>
+  <th>Attempts</th>
 </tr>
 {{range .Requests}}
 <tr>
   <td>{{.Idx}}</td>
   <td>{{.URL}}</td>
   <td>{{.Client}}</td>
+  <td>{{.User}}</td>
   <td>{{.Proxy}}</td>
   <td>{{.ClientHandlerRunning}}</td>
   <td>{{.ProxyHandlerRunning}}</td>
   <td>{{.ActiveSeconds}}</td>
+  <td>{{.Attempts}}</td>
+</tr>
+{{end}}
+</table>
+
+<h3>Proxies:</h3>
+<table>
+<tr>
+  <th>Proxy</th>
+  <th>Fail counter</th>
+  <th>Last check</th>
+  <th>Anonymity</th>
+  <th>Connect, ms</th>
+  <th>First byte, ms</th>
+  <th>Total, ms</th>
+  <th>Last first bytes, ms</th>
+  <th>Tags</th>
+</tr>
+{{range .Proxies}}
+<tr>
+  <td>{{.Name}}</td>
+  <td>{{.FailCounter}}</td>
+  <td>{{.LastCheck.Format "2006-01-02 15:04:05"}}</td>
+  <td>{{.Anonymity}}</td>
+  <td>{{ms .Latency.Average.Connect}}</td>
+  <td>{{ms .Latency.Average.FirstByte}}</td>
+  <td>{{ms .Latency.Average.Total}}</td>
+  <td>{{range .Latency.History}}{{ms .FirstByte}} {{end}}</td>
+  <td>{{range .Tags}}{{.}} {{end}}</td>
+</tr>
+{{end}}
+</table>
+
+{{define "trafficHeader"}}
+<tr>
+  <th>{{.}}</th>
+  <th>Requests</th>
+  <th>Bytes in</th>
+  <th>Bytes out</th>
+  <th>Status</th>
+  <th>Errors</th>
+</tr>
+{{end}}
+{{define "trafficRow"}}
+  <td>{{.Requests}}</td>
+  <td>{{.BytesIn}}</td>
+  <td>{{.BytesOut}}</td>
+  <td>{{range $k, $v := .Status}}{{$k}}: {{$v}} {{end}}</td>
+  <td>{{range $k, $v := .Errors}}{{$k}}: {{$v}} {{end}}</td>
+{{end}}
+
+<h3>Traffic by proxy:</h3>
+<table>
+{{template "trafficHeader" "Proxy"}}
+{{range $name, $t := .ProxyTraffic}}
+<tr>
+  <td>{{$name}}</td>
+  {{template "trafficRow" $t}}
+</tr>
+{{end}}
+</table>
+
+<h3>Traffic by client:</h3>
+<table>
+{{template "trafficHeader" "Client"}}
+{{range $client, $t := .ClientTraffic}}
+<tr>
+  <td>{{$client}}</td>
+  {{template "trafficRow" $t}}
 </tr>
 {{end}}
 </table>
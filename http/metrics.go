@@ -0,0 +1,40 @@
+package http
+
+import (
+	"github.com/olomix/dynproxy/metrics"
+	"github.com/olomix/dynproxy/proxy_cache"
+	"github.com/olomix/dynproxy/stats"
+)
+
+const metricsPath = "/metrics"
+
+// Register gauges read from stats and cache on every scrape
+func registerGauges(grs *stats.GoRoutineStats, pCache proxy_cache.ProxyCache) {
+	metrics.NewGaugeFunc(
+		"dynproxy_client_handlers",
+		"Running handlers of client to proxy traffic.",
+		func() float64 { return float64(grs.GetClientProxy()) })
+	metrics.NewGaugeFunc(
+		"dynproxy_proxy_handlers",
+		"Running handlers of proxy to client traffic.",
+		func() float64 { return float64(grs.GetProxyClient()) })
+	metrics.NewGaugeFunc(
+		"dynproxy_checks_in_flight",
+		"Running proxy checks.",
+		func() float64 { return float64(grs.GetCheckProxy()) })
+	metrics.NewGaugeFunc(
+		"dynproxy_active_requests",
+		"Client requests being served.",
+		func() float64 { return float64(len(grs.ActiveRequests())) })
+	metrics.NewGaugeVecFunc(
+		"dynproxy_proxies",
+		"Known proxies by state.",
+		"state",
+		func() map[string]float64 {
+			stats := pCache.Stats()
+			return map[string]float64{
+				"good": float64(stats.Good),
+				"bad":  float64(stats.Proxies - stats.Good),
+			}
+		})
+}
@@ -2,65 +2,296 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"github.com/olomix/dynproxy/auth"
 	chttp "github.com/olomix/dynproxy/http"
 	"github.com/olomix/dynproxy/log"
 	"github.com/olomix/dynproxy/proxy_cache"
 	"github.com/olomix/dynproxy/stats"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const PROXY_HEADER = "X-Dynproxy-Proxy"
+const proxyDialTimeout = 30 * time.Second
+const proxyResponseTimeout = 60 * time.Second
+
+// Idle upstream connection kept for client is closed after this time.
+// Variable to be shortened in tests.
+var upstreamIdleTimeout time.Duration = 30 * time.Second
+
+// Policies of overriding proxy with PROXY_HEADER: allow any address, only
+// proxies known to cache or only proxies in good state.
+const (
+	overrideAny   = "any"
+	overrideKnown = "known"
+	overrideGood  = "good"
+)
+
+var errOverrideForbidden = errors.New("proxy override is not allowed")
+
+// Proxy in PROXY_HEADER can't be parsed
+type badOverrideError struct {
+	err error
+}
+
+func (e badOverrideError) Error() string {
+	return fmt.Sprintf("malformed %v header: %v", PROXY_HEADER, e.err)
+}
+
+// Policies of choosing proxy for requests on keep-alive client connection
+const (
+	proxyPerRequest    = "request"
+	proxyPerConnection = "connection"
+)
 
 var proxyFileName string
 var listenAddress string
+var socksListenAddress string
+var proxyPolicy string
+var maxAttempts int
+var overridePolicy string
+var checkServerAddress string
+var shutdownTimeout time.Duration
+
+// Clients allowed to use proxy, nil if authentication is disabled
+var users *auth.Users
+
+// What clients are allowed to do, nil if everything is allowed
+var policies *auth.Policies
 
 func init() {
-	flag.StringVar(&proxyFileName, "in", "-", "file to read proxies from")
+	flag.StringVar(
+		&proxyFileName,
+		"in", "-", "file to read proxies from, - for stdin, none if empty")
 	flag.StringVar(
 		&listenAddress,
 		"listen", "0.0.0.0:3128", "address to listen on")
-	flag.Parse()
+	flag.StringVar(
+		&socksListenAddress,
+		"socks-listen", "",
+		"address to listen for SOCKS5 clients on, disabled if empty")
+	flag.StringVar(
+		&proxyPolicy,
+		"proxy-policy", proxyPerRequest,
+		fmt.Sprintf(
+			"choose new proxy for each request (%v) or keep one proxy "+
+				"for all requests of client connection (%v)",
+			proxyPerRequest, proxyPerConnection))
+	flag.StringVar(
+		&overridePolicy,
+		"override-policy", overrideKnown,
+		fmt.Sprintf(
+			"which proxies client may force with %v header: %v, %v or %v",
+			PROXY_HEADER, overrideAny, overrideKnown, overrideGood))
+	flag.StringVar(
+		&checkServerAddress,
+		"check-server", "",
+		"address to serve proxy check target on, disabled if empty. "+
+			"With empty -listen only check target is served")
+	flag.DurationVar(
+		&shutdownTimeout,
+		"shutdown-timeout", 30*time.Second,
+		"how long to wait for active requests on SIGTERM or SIGINT "+
+			"before closing them")
+	flag.IntVar(
+		&maxAttempts,
+		"attempts", 3,
+		"how many proxies to try for one request before giving up")
 }
 
 func main() {
 	flag.Parse()
 	log.SetupLogs()
 
-	var grs *stats.GoRoutineStats = stats.New()
+	if proxyPolicy != proxyPerRequest && proxyPolicy != proxyPerConnection {
+		log.Errorf("Unknown proxy policy: %v", proxyPolicy)
+		os.Exit(1)
+	}
+	switch overridePolicy {
+	case overrideAny, overrideKnown, overrideGood:
+	default:
+		log.Errorf("Unknown override policy: %v", overridePolicy)
+		os.Exit(1)
+	}
+
+	if checkServerAddress != "" {
+		if err := proxy_cache.CheckServerError(); err != nil {
+			log.Errorf("Can't serve check target: %v", err)
+			os.Exit(1)
+		}
+		if listenAddress == "" {
+			log.Error(proxy_cache.ServeCheckTarget(checkServerAddress))
+			os.Exit(1)
+		}
+		go func() {
+			log.Error(proxy_cache.ServeCheckTarget(checkServerAddress))
+			os.Exit(1)
+		}()
+	}
 
-	var addr *net.TCPAddr
 	var err error
-	var pCache proxy_cache.ProxyCache = proxy_cache.NewProxyCache(
-		proxyFileName, grs)
-	addr, err = net.ResolveTCPAddr("tcp", listenAddress)
+	if users, err = auth.LoadUsers(); err != nil {
+		log.Errorf("Can't load users: %v", err)
+		os.Exit(1)
+	}
+	if policies, err = auth.LoadPolicies(); err != nil {
+		log.Errorf("Can't load policies: %v", err)
+		os.Exit(1)
+	}
+
+	var grs *stats.GoRoutineStats = stats.New()
+
+	pCache, err := proxy_cache.NewProxyCache(proxyFileName, grs)
 	if err != nil {
-		panic(fmt.Sprintf("can't resolve addr %v: %v", listenAddress, err))
+		log.Errorf("Can't start proxy cache: %v", err)
+		os.Exit(1)
 	}
 
-	chttp.ListenAndServe(grs)
+	var controlServer *http.Server = chttp.ListenAndServe(
+		grs, pCache, users, policies)
 
 	var server *net.TCPListener
-	server, err = net.ListenTCP("tcp", addr)
+	server, err = listenTCP(listenAddress)
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
+	go serveProxy(server, pCache, grs)
 
+	var socksServer *net.TCPListener
+	if socksListenAddress != "" {
+		socksServer, err = listenTCP(socksListenAddress)
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+		go serveSocks(socksServer, pCache, grs)
+	}
+
+	go reloadOnSignal(pCache)
+
+	sig := waitForSignal()
+	log.Printf("Got %v, shutting down", sig)
+
+	// Listeners are closed after connections are marked closing, so accept
+	// loops know error is expected.
+	var deadline time.Time = time.Now().Add(shutdownTimeout)
+	connections.close()
+	server.Close()
+	if socksServer != nil {
+		socksServer.Close()
+	}
+	connections.wait(shutdownTimeout)
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	if err = controlServer.Shutdown(ctx); err != nil {
+		controlServer.Close()
+	}
+	// Stop checks and save proxies for next start
+	pCache.Stop(ctx)
+	log.Print("Stopped")
+}
+
+// Accept proxy clients and handle each one in separate goroutine.
+func serveProxy(
+	server *net.TCPListener,
+	pCache proxy_cache.ProxyCache,
+	grs *stats.GoRoutineStats,
+) {
 	for {
-		var conn *net.TCPConn
-		conn, err = server.AcceptTCP()
+		conn, err := server.AcceptTCP()
 		if err != nil {
+			if connections.isClosing() {
+				return
+			}
 			log.Error(err)
 			panic(err)
 		}
 		go handleConnection(conn, pCache, grs)
 	}
+}
+
+// Reload proxies from input file on SIGHUP.
+func reloadOnSignal(pCache proxy_cache.ProxyCache) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		if err := pCache.Reload(); err != nil {
+			log.Errorf("Can't reload proxies: %v", err)
+		}
+	}
+}
+
+func listenTCP(address string) (*net.TCPListener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, fmt.Errorf("can't resolve addr %v: %v", address, err)
+	}
+	return net.ListenTCP("tcp", addr)
+}
+
+// Upstream connection kept open between requests of one client connection.
+type upstreamConn struct {
+	key    string // see upstreamKey
+	conn   net.Conn
+	reader *bufio.Reader
+	idle   *time.Timer // closes connection if it is not reused in time
+}
+
+// State of one client connection shared by all requests received on it.
+type clientState struct {
+	conn     *net.TCPConn
+	reader   *bufio.Reader
+	proxy    proxy_cache.Proxy // proxy used by previous request
+	upstream *upstreamConn     // idle upstream connection, nil if none
+}
+
+// Keep upstream connection for next request of client. Only one connection
+// is kept, previous one is closed.
+func (cs *clientState) keepUpstream(u *upstreamConn) {
+	cs.closeUpstream()
+	var conn net.Conn = u.conn
+	u.idle = time.AfterFunc(upstreamIdleTimeout, func() { conn.Close() })
+	cs.upstream = u
+}
+
+// Take idle upstream connection with key. Return nil if there is none or
+// it is closed by idle timeout. Connection with other key is closed.
+func (cs *clientState) takeUpstream(key string) *upstreamConn {
+	var u *upstreamConn = cs.upstream
+	if u == nil {
+		return nil
+	}
+	cs.upstream = nil
+	if !u.idle.Stop() {
+		return nil
+	}
+	if u.key != key {
+		u.conn.Close()
+		return nil
+	}
+	return u
+}
 
+func (cs *clientState) closeUpstream() {
+	if cs.upstream != nil {
+		cs.upstream.idle.Stop()
+		cs.upstream.conn.Close()
+		cs.upstream = nil
+	}
 }
 
 func handleConnection(
@@ -68,90 +299,612 @@ func handleConnection(
 	pCache proxy_cache.ProxyCache,
 	grs *stats.GoRoutineStats,
 ) {
+	var cs *clientState = &clientState{
+		conn:   clientConn,
+		reader: bufio.NewReader(clientConn),
+	}
+	if !connections.add(clientConn, true) {
+		clientConn.Close()
+		return
+	}
+	defer connections.remove(clientConn)
+	defer clientConn.Close()
+	defer cs.closeUpstream()
 
-	requestIdx := grs.NewRequest(clientConn.RemoteAddr().String())
-	defer grs.StopClientHandler(requestIdx)
+	for handleRequest(cs, pCache, grs) && connections.setIdle(clientConn) {
+	}
+}
 
+// Read and serve one request from client connection. Return true if
+// connection should be kept alive for next request.
+func handleRequest(
+	cs *clientState,
+	pCache proxy_cache.ProxyCache,
+	grs *stats.GoRoutineStats,
+) bool {
 	var (
-		bufReader *bufio.Reader = bufio.NewReader(clientConn)
-		req       *http.Request
-		err       error
+		req *http.Request
+		err error
 	)
-	if req, err = http.ReadRequest(bufReader); err != nil {
-		log.Errorf("%v: Error on reading request: %v", requestIdx, err)
-		return
+	if req, err = http.ReadRequest(cs.reader); err != nil {
+		if err != io.EOF && !connections.isClosing() {
+			log.Errorf(
+				"%v: Error on reading request: %v",
+				cs.conn.RemoteAddr(), err)
+		}
+		return false
 	}
+	connections.setActive(cs.conn)
+
+	var kind string = requestKindHTTP
+	if req.Method == "CONNECT" {
+		kind = requestKindConnect
+	}
+	defer func(start time.Time) {
+		requestDuration.Observe(time.Since(start).Seconds(), kind)
+	}(time.Now())
+	var traffic *requestTraffic = newRequestTraffic(
+		grs, cs.conn.RemoteAddr())
+	defer traffic.done()
+
+	requestIdx := grs.NewRequest(cs.conn.RemoteAddr().String())
+	defer grs.StopClientHandler(requestIdx)
+
 	log.Debugf("%v: Got request to %v", requestIdx, req.URL)
-	grs.SetUrl(requestIdx, req.URL.String())
+	if req.Method == "CONNECT" {
+		grs.SetUrl(requestIdx, fmt.Sprintf("CONNECT %v", req.Host))
+	} else {
+		// Request in origin form, complete URL from Host header
+		if req.URL.Host == "" {
+			req.URL.Host = req.Host
+		}
+		if req.URL.Scheme == "" {
+			req.URL.Scheme = "http"
+		}
+		grs.SetUrl(requestIdx, req.URL.String())
+	}
+
+	user, ok := authenticateRequest(req)
+	if !ok {
+		log.Errorf(
+			"%v: Client %v failed authentication",
+			requestIdx, cs.conn.RemoteAddr())
+		var header http.Header = make(http.Header)
+		header.Set("Proxy-Authenticate", `Basic realm="dynproxy"`)
+		traffic.fail(errorTypeAuth)
+		traffic.writeError(cs.conn, http.StatusProxyAuthRequired, header)
+		return false
+	}
+	grs.SetUser(requestIdx, user)
+	traffic.setUser(user)
+
+	policy, ok := policies.Lookup(user)
+	if !ok || !policy.AllowTarget(targetAddr(req.URL)) {
+		log.Errorf(
+			"%v: User %q is not allowed to connect to %v",
+			requestIdx, user, targetAddr(req.URL))
+		traffic.fail(errorTypeDenied)
+		traffic.writeError(cs.conn, http.StatusForbidden, nil)
+		return false
+	}
+
+	var (
+		proxy proxy_cache.Proxy
+		tries attempts
+	)
+	opts := requestOptions(req)
+	if users != nil {
+		// Credentials of client are for dynproxy only
+		req.Header.Del("Proxy-Authorization")
+	}
+	if tries.pool, ok = restrictPool(policy, opts.pool); !ok {
+		log.Errorf(
+			"%v: User %q is not allowed to use pool %v",
+			requestIdx, user, strings.Join(opts.pool, ","))
+		traffic.fail(errorTypeDenied)
+		traffic.writeError(cs.conn, http.StatusForbidden, nil)
+		return false
+	}
+	opts.pool = tries.pool
+	proxy, tries.forced, err = chooseProxy(
+		cs, req, user, opts, policy, pCache)
+	if err == errOverrideForbidden {
+		log.Errorf(
+			"%v: Client %v asked for not allowed proxy %v",
+			requestIdx, cs.conn.RemoteAddr(), proxy.Name())
+		traffic.fail(errorTypeDenied)
+		traffic.writeError(cs.conn, http.StatusForbidden, nil)
+		return false
+	}
+	if _, ok := err.(badOverrideError); ok {
+		log.Errorf(
+			"%v: Client %v sent %v", requestIdx, cs.conn.RemoteAddr(), err)
+		traffic.fail(errorTypeBadRequest)
+		traffic.writeError(cs.conn, http.StatusBadRequest, nil)
+		return false
+	}
+	if err != nil {
+		log.Errorf("%v: Can't get next proxy: %v", requestIdx, err)
+		traffic.fail(errorTypeNoProxy)
+		traffic.writeError(cs.conn, http.StatusBadGateway, nil)
+		return false
+	}
+
+	if req.Method == "CONNECT" {
+		handleTunnel(
+			cs, req, proxy, &tries, pCache, grs, requestIdx, traffic)
+		return false
+	}
+
+	var replayable bool
+	if replayable, err = bufferBody(req); err != nil {
+		log.Errorf("%v: Error on reading request body: %v", requestIdx, err)
+		traffic.fail(errorTypeClient)
+		return false
+	}
+
+	var (
+		u      *upstreamConn
+		resp   *http.Response
+		timing proxy_cache.Timing
+		key    string
+		start  time.Time
+	)
+	for {
+		cs.proxy = proxy
+		tries.add(&proxy)
+		grs.NewAttempt(requestIdx, proxy.Name())
+		traffic.attempt(proxy.Name())
+		log.Printf("%v: Handle request with %v", requestIdx, proxy.Name())
+
+		key = upstreamKey(&proxy, req)
+		pCache.Acquire(proxy.Addr)
+		start = time.Now()
+		u, resp, timing, err = roundTrip(
+			cs, req, &proxy, key, requestIdx, traffic)
+		if err == nil {
+			break
+		}
+		reportResult(pCache, &proxy, resp, timing, err)
+		pCache.Release(proxy.Addr)
+		traffic.attemptFailed(err)
+		log.Errorf(
+			"%v: Request to proxy %v failed: %v",
+			requestIdx, proxy.Name(), err)
+
+		_, isDialError := err.(dialError)
+		if !tries.canRetry() ||
+			!(isDialError || replayable && rewindBody(req)) {
+			traffic.writeError(
+				cs.conn, http.StatusBadGateway, tries.header())
+			return false
+		}
+		if proxy, err = tries.nextProxy(pCache); err != nil {
+			log.Errorf("%v: Can't get next proxy: %v", requestIdx, err)
+			traffic.writeError(
+				cs.conn, http.StatusBadGateway, tries.header())
+			return false
+		}
+	}
+
+	defer pCache.Release(proxy.Addr)
+
+	grs.StartProxyHandler(requestIdx)
+	keepAlive := copyProxyToClient(
+		cs.conn, resp, tries.header(), grs, requestIdx, traffic)
+	if keepAlive {
+		// Body is copied, so request took its total time
+		timing.Total = time.Since(start)
+	}
+	reportResult(pCache, &proxy, resp, timing, nil)
+	if !keepAlive || resp.Close {
+		u.conn.Close()
+	} else {
+		cs.keepUpstream(u)
+	}
+	return keepAlive && !req.Close && !resp.Close
+}
 
-	var proxy string
+// Choose proxy for request of user. Client may force proxy with header or
+// ask for sticky session, otherwise proxy is taken from cache according to
+// proxy policy. Return true if proxy was forced by client.
+func chooseProxy(
+	cs *clientState,
+	req *http.Request,
+	user string,
+	opts clientOptions,
+	policy *auth.Policy,
+	pCache proxy_cache.ProxyCache,
+) (proxy_cache.Proxy, bool, error) {
 	if proxies, ok := req.Header[PROXY_HEADER]; ok && len(proxies) > 0 {
-		proxy = proxies[0]
 		req.Header.Del(PROXY_HEADER)
+		proxy, err := proxy_cache.ParseProxy(proxies[0])
+		if err != nil {
+			return proxy, true, badOverrideError{err}
+		}
+		known, isKnown := pCache.LookupProxy(proxy.Addr)
+		switch {
+		case !policy.Override,
+			overridePolicy == overrideKnown && !isKnown,
+			overridePolicy == overrideGood && !pCache.IsGood(proxy.Addr),
+			// client restricted to pool may force only proxies from it
+			len(opts.pool) > 0 && !(isKnown && known.InPool(opts.pool)):
+			return proxy, true, errOverrideForbidden
+		}
+		// Use credentials of known proxy if client sent none
+		if isKnown && !proxy.HasCredentials() {
+			return known, true, nil
+		}
+		return proxy, true, nil
+	}
+	if opts.session != "" {
+		proxy, err := pCache.SessionProxy(user, opts.session, opts.pool)
+		return proxy, false, err
+	}
+	if proxyPolicy == proxyPerConnection && cs.proxy.Addr != "" &&
+		cs.proxy.InPool(opts.pool) {
+		return cs.proxy, false, nil
+	}
+	proxy, err := pCache.NextProxyInPool(opts.pool)
+	return proxy, false, err
+}
+
+// Feed result of request through proxy back to cache. Failures to connect
+// or to get reply count against proxy as well as replies meaning proxy
+// can't serve request: 407 and 5xx. Timing of successful request updates
+// latency of proxy.
+func reportResult(
+	pCache proxy_cache.ProxyCache,
+	proxy *proxy_cache.Proxy,
+	resp *http.Response,
+	timing proxy_cache.Timing,
+	err error,
+) {
+	if err != nil || resp.StatusCode == http.StatusProxyAuthRequired ||
+		resp.StatusCode >= 500 {
+		pCache.ReportFailure(proxy.Addr)
 	} else {
-		proxy, err = pCache.NextProxy()
+		pCache.ReportSuccess(proxy.Addr, timing)
+	}
+}
+
+// Authorize request on upstream proxy if proxy has credentials.
+func setProxyAuthorization(req *http.Request, proxy *proxy_cache.Proxy) {
+	if auth := proxy.ProxyAuthorization(); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+}
+
+// Key to find idle upstream connection. Connections to HTTP proxies may be
+// reused for any target, while SOCKS tunnels are bound to target address.
+func upstreamKey(proxy *proxy_cache.Proxy, req *http.Request) string {
+	if proxy.IsHTTP() {
+		return proxy.Name()
+	}
+	return fmt.Sprintf("%v %v", proxy.Name(), targetAddr(req.URL))
+}
+
+// Return host:port of request target, with default port if URL has none.
+func targetAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// Send request to proxy and read response headers. Reuse idle upstream
+// connection if client already has one to this proxy. If reused connection
+// turns out to be closed by proxy before it replied anything and request
+// is idempotent, retry once on new connection. Return time to connect and
+// to get response headers.
+func roundTrip(
+	cs *clientState,
+	req *http.Request,
+	proxy *proxy_cache.Proxy,
+	key string,
+	requestIdx stats.RequestIdx,
+	traffic *requestTraffic,
+) (*upstreamConn, *http.Response, proxy_cache.Timing, error) {
+	var (
+		u      *upstreamConn
+		reused bool
+		resp   *http.Response
+		timing proxy_cache.Timing
+		err    error
+		start  time.Time = time.Now()
+	)
+	if u = cs.takeUpstream(key); u != nil {
+		reused = true
+		log.Debugf("%v: Reuse connection to %v", requestIdx, key)
+	} else {
+		var proxyConn net.Conn
+		if proxy.IsHTTP() {
+			proxyConn, err = proxy.Dial(proxyDialTimeout)
+		} else {
+			proxyConn, err = proxy.DialTunnel(
+				targetAddr(req.URL), proxyDialTimeout)
+		}
 		if err != nil {
-			log.Errorf("%v: Can't get next proxy: %v", requestIdx, err)
-			clientConn.Close()
-			return
+			return nil, nil, timing, dialError{err}
+		}
+		timing.Connect = time.Since(start)
+		u = &upstreamConn{
+			key: key, conn: proxyConn, reader: bufio.NewReader(proxyConn)}
+	}
+
+	var upstream *countingWriter = &countingWriter{w: u.conn}
+	if proxy.IsHTTP() {
+		setProxyAuthorization(req, proxy)
+		err = req.WriteProxy(upstream)
+	} else {
+		err = req.Write(upstream)
+	}
+	bytesTotal.Add(float64(upstream.n), directionUpstream)
+	traffic.out += upstream.n
+	// true if proxy closed connection and did not reply anything
+	var closed bool = isConnClosed(err)
+	if err == nil {
+		u.conn.SetReadDeadline(time.Now().Add(proxyResponseTimeout))
+		if _, err = u.reader.Peek(1); err == nil {
+			resp, err = http.ReadResponse(u.reader, req)
+		} else {
+			closed = isConnClosed(err)
 		}
+		u.conn.SetReadDeadline(time.Time{})
+		timing.FirstByte = time.Since(start)
 	}
-	grs.SetProxy(requestIdx, proxy)
-	var proxyAddr *net.TCPAddr
-	proxyAddr, err = net.ResolveTCPAddr("tcp", proxy)
 	if err != nil {
-		log.Errorf("%v: can't resolve addr %v: %v", requestIdx, proxy, err)
-		clientConn.Close()
-		return
+		u.conn.Close()
+		if reused && closed && isIdempotent(req.Method) && rewindBody(req) {
+			log.Debugf(
+				"%v: Reused connection to %v failed, redial: %v",
+				requestIdx, key, err)
+			return roundTrip(cs, req, proxy, key, requestIdx, traffic)
+		}
+		return nil, nil, timing, err
+	}
+	return u, resp, timing, nil
+}
+
+// Return true if error means that connection was closed by other side.
+// Timeouts are not closes.
+func isConnClosed(err error) bool {
+	return err == io.EOF || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// Write response to client and return true if response was written
+// completely, so client connection may be used for next request.
+func copyProxyToClient(
+	clientConn *net.TCPConn,
+	resp *http.Response, header http.Header,
+	grs *stats.GoRoutineStats,
+	requestIdx stats.RequestIdx,
+	traffic *requestTraffic,
+) bool {
+	defer grs.StopProxyHandler(requestIdx)
+	defer resp.Body.Close()
+
+	for k, v := range header {
+		resp.Header[k] = v
 	}
-	var proxyConn *net.TCPConn
-	log.Printf("%v: Handle connection with %v", requestIdx, proxy)
-	proxyConn, err = net.DialTCP("tcp", nil, proxyAddr)
+	var downstream *countingWriter = &countingWriter{w: clientConn}
+	err := resp.Write(downstream)
+	bytesTotal.Add(float64(downstream.n), directionDownstream)
+	traffic.in += downstream.n
+	traffic.status = resp.StatusCode
 	if err != nil {
-		log.Errorf("%v: can't deal to proxy: %v", requestIdx, err)
-		clientConn.Close()
+		log.Errorf("%v: Error on writing response to client: %v", requestIdx, err)
+		traffic.fail(errorTypeClient)
+		return false
+	}
+	log.Debugf("%v: Proxy to client handler done", requestIdx)
+	return true
+}
+
+// Reply to client with status text in body and given headers and close
+// connection after it.
+func writeError(clientConn io.Writer, status int, header http.Header) {
+	if header == nil {
+		header = make(http.Header)
+	}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	var body string = fmt.Sprintf("%d %s\n", status, http.StatusText(status))
+	resp := &http.Response{
+		StatusCode:    status,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          ioutil.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Close:         true,
+	}
+	resp.Write(clientConn)
+}
+
+// Establish CONNECT tunnel through proxy and then copy raw bytes in both
+// directions until one of sides closes connection. If tunnel can't be
+// opened, retry with another proxy.
+func handleTunnel(
+	cs *clientState,
+	req *http.Request, proxy proxy_cache.Proxy,
+	tries *attempts,
+	pCache proxy_cache.ProxyCache,
+	grs *stats.GoRoutineStats,
+	requestIdx stats.RequestIdx,
+	traffic *requestTraffic,
+) {
+	var (
+		proxyConn   net.Conn
+		proxyReader io.Reader
+		resp        *http.Response
+		err         error
+	)
+	for {
+		cs.proxy = proxy
+		tries.add(&proxy)
+		grs.NewAttempt(requestIdx, proxy.Name())
+		traffic.attempt(proxy.Name())
+		log.Printf("%v: Handle tunnel with %v", requestIdx, proxy.Name())
+
+		pCache.Acquire(proxy.Addr)
+		start := time.Now()
+		proxyConn, proxyReader, resp, err = dialTunnel(req, &proxy)
+		reportResult(
+			pCache, &proxy, resp,
+			proxy_cache.Timing{Connect: time.Since(start)}, err)
+		if err == nil {
+			break
+		}
+		pCache.Release(proxy.Addr)
+		traffic.attemptFailed(err)
+		log.Errorf(
+			"%v: Can't open tunnel with proxy %v: %v",
+			requestIdx, proxy.Name(), err)
+		if !tries.canRetry() {
+			traffic.writeError(
+				cs.conn, http.StatusBadGateway, tries.header())
+			return
+		}
+		if proxy, err = tries.nextProxy(pCache); err != nil {
+			log.Errorf("%v: Can't get next proxy: %v", requestIdx, err)
+			traffic.writeError(
+				cs.conn, http.StatusBadGateway, tries.header())
+			return
+		}
+	}
+	defer proxyConn.Close()
+	defer pCache.Release(proxy.Addr)
+
+	for k, v := range tries.header() {
+		resp.Header[k] = v
+	}
+	traffic.status = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		log.Printf(
+			"%v: Proxy %v refused tunnel to %v: %v",
+			requestIdx, proxy.Name(), req.Host, resp.Status)
+		var downstream *countingWriter = &countingWriter{w: cs.conn}
+		resp.Write(downstream)
+		traffic.in += downstream.n
 		return
 	}
 
-	err = req.Write(proxyConn)
+	// Response to CONNECT has no body, all data after headers belongs
+	// to tunnel. So write only status line and headers.
+	_, err = fmt.Fprintf(cs.conn, "HTTP/1.1 %v\r\n", resp.Status)
+	if err == nil {
+		err = resp.Header.Write(cs.conn)
+	}
+	if err == nil {
+		_, err = io.WriteString(cs.conn, "\r\n")
+	}
 	if err != nil {
-		log.Errorf("%v: Error on copying from client to proxy: %v", requestIdx, err)
+		log.Errorf("%v: Error on writing CONNECT response to client: %v", requestIdx, err)
+		traffic.fail(errorTypeClient)
 		return
 	}
 
-	grs.StartProxyHandler(requestIdx)
-	go copyProxyToClient(clientConn, proxyConn, req, proxy, grs, requestIdx)
+	in, out := pipeTunnel(
+		cs.conn, proxyConn, cs.reader, proxyReader, grs, requestIdx)
+	traffic.in += in
+	traffic.out += out
+}
+
+// Open tunnel for client CONNECT request. HTTP proxy gets CONNECT request
+// and its reply is returned as is. For SOCKS proxy tunnel is opened with
+// SOCKS handshake and reply is made up.
+func dialTunnel(
+	req *http.Request, proxy *proxy_cache.Proxy,
+) (net.Conn, io.Reader, *http.Response, error) {
+	if !proxy.IsHTTP() {
+		proxyConn, err := proxy.DialTunnel(req.Host, proxyDialTimeout)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		resp := &http.Response{
+			Status:     "200 Connection established",
+			StatusCode: http.StatusOK,
+			Header:     make(http.Header),
+		}
+		return proxyConn, proxyConn, resp, nil
+	}
 
-	var l int64
-	l, err = io.Copy(proxyConn, clientConn)
+	proxyConn, err := proxy.Dial(proxyDialTimeout)
 	if err != nil {
-		log.Errorf("%v: Error on extra copying from client to proxy: %v", requestIdx, err)
-		return
+		return nil, nil, nil, err
 	}
-	log.Printf("%v: Copied %d bytes from client to proxy", requestIdx, l)
+	setProxyAuthorization(req, proxy)
+	proxyReader, resp, err := openTunnel(proxyConn, req)
+	if err != nil {
+		proxyConn.Close()
+		return nil, nil, nil, err
+	}
+	return proxyConn, proxyReader, resp, nil
 }
 
-func copyProxyToClient(
-	clientConn, proxyConn *net.TCPConn,
-	req *http.Request, proxy string,
+// Send CONNECT request to proxy and read its reply. Returned reader must be
+// used to read tunnel data from proxy as it may hold already buffered bytes.
+func openTunnel(
+	proxyConn net.Conn, req *http.Request,
+) (*bufio.Reader, *http.Response, error) {
+	if err := req.Write(proxyConn); err != nil {
+		return nil, nil, err
+	}
+	var proxyReader *bufio.Reader = bufio.NewReader(proxyConn)
+	resp, err := http.ReadResponse(proxyReader, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return proxyReader, resp, nil
+}
+
+// Copy raw bytes between client and proxy in both directions until both
+// sides finish. Return bytes copied from proxy to client and from client
+// to proxy.
+func pipeTunnel(
+	clientConn, proxyConn net.Conn,
+	clientReader, proxyReader io.Reader,
 	grs *stats.GoRoutineStats,
 	requestIdx stats.RequestIdx,
-) {
-	defer grs.StopProxyHandler(requestIdx)
-
+) (int64, int64) {
+	grs.StartProxyHandler(requestIdx)
 	var (
-		err       error
-		bufReader *bufio.Reader = bufio.NewReader(proxyConn)
-		resp      *http.Response
+		done chan struct{} = make(chan struct{})
+		in   int64
 	)
-	resp, err = http.ReadResponse(bufReader, req)
+	go func() {
+		defer close(done)
+		defer grs.StopProxyHandler(requestIdx)
+		in = copyTunnel(clientConn, proxyReader, requestIdx)
+		bytesTotal.Add(float64(in), directionDownstream)
+		log.Printf("%v: Copied %d bytes from proxy to client", requestIdx, in)
+	}()
+
+	out := copyTunnel(proxyConn, clientReader, requestIdx)
+	bytesTotal.Add(float64(out), directionUpstream)
+	log.Printf("%v: Copied %d bytes from client to proxy", requestIdx, out)
+	<-done
+	return in, out
+}
+
+// Copy tunnel data from src to dst. When src is exhausted, close write side
+// of dst so the other end of tunnel gets EOF too.
+func copyTunnel(
+	dst net.Conn, src io.Reader, requestIdx stats.RequestIdx,
+) int64 {
+	l, err := io.Copy(dst, src)
 	if err != nil {
-		log.Errorf("%v: Can't read response from proxy: %v", requestIdx, err)
-		proxyConn.Close()
-		clientConn.Close()
-		return
+		log.Debugf("%v: Tunnel copy error: %v", requestIdx, err)
 	}
-	resp.Header.Add(PROXY_HEADER, proxy)
-	resp.Write(clientConn)
-	log.Debugf("%v: Proxy to client handler done", requestIdx)
+	if cw, ok := dst.(interface {
+		CloseWrite() error
+	}); ok {
+		cw.CloseWrite()
+	}
+	return l
 }
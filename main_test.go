@@ -0,0 +1,592 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/olomix/dynproxy/auth"
+	"github.com/olomix/dynproxy/proxy_cache"
+	"github.com/olomix/dynproxy/stats"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Proxy cache for tests. Proxies are given out in turn.
+type testCache struct {
+	proxy_cache.ProxyCache
+	lock     sync.Mutex
+	proxies  []proxy_cache.Proxy
+	next     int
+	bad      map[string]bool
+	failures map[string]int
+	timings  []proxy_cache.Timing // of successful requests
+}
+
+func newTestCache(proxies ...proxy_cache.Proxy) *testCache {
+	return &testCache{
+		proxies:  proxies,
+		bad:      make(map[string]bool),
+		failures: make(map[string]int),
+	}
+}
+
+func (c *testCache) NextProxyInPool(pool []string) (proxy_cache.Proxy, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.proxies) == 0 {
+		return proxy_cache.Proxy{}, errors.New("no proxies")
+	}
+	proxy := c.proxies[c.next%len(c.proxies)]
+	c.next++
+	return proxy, nil
+}
+
+func (c *testCache) SessionProxy(
+	user, session string, pool []string,
+) (proxy_cache.Proxy, error) {
+	return c.NextProxyInPool(pool)
+}
+
+func (c *testCache) LookupProxy(addr string) (proxy_cache.Proxy, bool) {
+	for _, p := range c.proxies {
+		if p.Addr == addr {
+			return p, true
+		}
+	}
+	return proxy_cache.Proxy{}, false
+}
+
+func (c *testCache) IsGood(addr string) bool {
+	_, known := c.LookupProxy(addr)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return known && !c.bad[addr]
+}
+
+func (c *testCache) ReportFailure(addr string) {
+	c.lock.Lock()
+	c.failures[addr]++
+	c.lock.Unlock()
+}
+
+func (c *testCache) ReportSuccess(addr string, timing proxy_cache.Timing) {
+	c.lock.Lock()
+	c.timings = append(c.timings, timing)
+	c.lock.Unlock()
+}
+
+func (c *testCache) Acquire(addr string) {}
+func (c *testCache) Release(addr string) {}
+
+// Request as seen by upstream proxy
+type upstreamRequest struct {
+	conn   int // number of connection it came on
+	method string
+	url    string
+	header http.Header
+	body   string
+}
+
+// Upstream HTTP proxy for tests. Every request is passed to handle, which
+// writes reply and returns false if connection should be closed.
+type testUpstream struct {
+	listener net.Listener
+	handle   func(conn net.Conn, r *bufio.Reader, req *http.Request) bool
+	lock     sync.Mutex
+	conns    int
+	requests []upstreamRequest
+}
+
+func newTestUpstream(
+	t *testing.T,
+	handle func(conn net.Conn, r *bufio.Reader, req *http.Request) bool,
+) *testUpstream {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var u *testUpstream = &testUpstream{listener: l, handle: handle}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			u.lock.Lock()
+			u.conns++
+			connNum := u.conns
+			u.lock.Unlock()
+			go u.serve(conn, connNum)
+		}
+	}()
+	return u
+}
+
+func (u *testUpstream) serve(conn net.Conn, connNum int) {
+	defer conn.Close()
+	var r *bufio.Reader = bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		body, _ := ioutil.ReadAll(req.Body)
+		u.lock.Lock()
+		u.requests = append(u.requests, upstreamRequest{
+			conn: connNum, method: req.Method, url: req.RequestURI,
+			header: req.Header, body: string(body)})
+		u.lock.Unlock()
+		if !u.handle(conn, r, req) {
+			return
+		}
+	}
+}
+
+func (u *testUpstream) proxy() proxy_cache.Proxy {
+	return proxy_cache.Proxy{
+		Addr: u.listener.Addr().String(), Scheme: proxy_cache.SchemeHTTP}
+}
+
+func (u *testUpstream) seen() []upstreamRequest {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	return append([]upstreamRequest(nil), u.requests...)
+}
+
+func (u *testUpstream) Close() {
+	u.listener.Close()
+}
+
+// Upstream handler replying 200 with request line in body
+func replyOK(conn net.Conn, r *bufio.Reader, req *http.Request) bool {
+	writeReply(conn, http.StatusOK, req.Method+" "+req.RequestURI)
+	return true
+}
+
+func writeReply(conn net.Conn, status int, body string) {
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: %d\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body)
+}
+
+// Proxy client connected to dynproxy serving it with pCache
+type testClient struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	grs    *stats.GoRoutineStats
+	done   chan struct{} // closed when dynproxy is done with connection
+}
+
+func newTestClient(t *testing.T, pCache proxy_cache.ProxyCache) *testClient {
+	l, err := net.ListenTCP(
+		"tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	var c *testClient = &testClient{
+		grs: stats.New(), done: make(chan struct{})}
+	go func() {
+		defer close(c.done)
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			return
+		}
+		handleConnection(conn, pCache, c.grs)
+	}()
+	if c.conn, err = net.Dial("tcp", l.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	c.reader = bufio.NewReader(c.conn)
+	return c
+}
+
+// Send raw request and read reply with its body
+func (c *testClient) do(t *testing.T, raw string) (*http.Response, string) {
+	if _, err := io.WriteString(c.conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := http.ReadResponse(c.reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func (c *testClient) Close() {
+	c.conn.Close()
+	<-c.done
+}
+
+func TestChooseProxyMalformedOverride(t *testing.T) {
+	for _, header := range []string{
+		"ftp://1.2.3.4:80", "1.2.3.4", "http://:80",
+	} {
+		req, _ := http.NewRequest("GET", "http://example.com/", nil)
+		req.Header.Set(PROXY_HEADER, header)
+		_, forced, err := chooseProxy(
+			&clientState{}, req, "", clientOptions{}, nil, nil)
+		if _, ok := err.(badOverrideError); !ok || !forced {
+			t.Fatalf("%q: expected bad override, got %v", header, err)
+		}
+		if req.Header.Get(PROXY_HEADER) != "" {
+			t.Fatalf("%q: header is not removed", header)
+		}
+	}
+}
+
+func TestRedialReusedConnection(t *testing.T) {
+	// Upstream serves first request of connection and closes it on second
+	// one without reply
+	var lock sync.Mutex
+	served := make(map[net.Conn]bool)
+	upstream := newTestUpstream(t,
+		func(conn net.Conn, r *bufio.Reader, req *http.Request) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			if served[conn] {
+				return false
+			}
+			served[conn] = true
+			return replyOK(conn, r, req)
+		})
+	defer upstream.Close()
+
+	client := newTestClient(t, newTestCache(upstream.proxy()))
+	defer client.Close()
+
+	get := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	client.do(t, get)
+	// idempotent request is sent again on new connection
+	resp, _ := client.do(t, get)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+	// not idempotent request is sent once even without body
+	resp, _ = client.do(t, "POST http://example.com/ HTTP/1.1\r\n"+
+		"Host: example.com\r\nContent-Length: 0\r\n\r\n")
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+
+	var methods []string
+	for _, r := range upstream.seen() {
+		methods = append(methods, fmt.Sprintf("%v@%d", r.method, r.conn))
+	}
+	if strings.Join(methods, " ") != "GET@1 GET@1 GET@2 POST@2" {
+		t.Fatalf("unexpected upstream requests %v", methods)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	var client *testClient
+	// Every request must be served as new one with its own stats
+	upstream := newTestUpstream(t,
+		func(conn net.Conn, r *bufio.Reader, req *http.Request) bool {
+			for _, active := range client.grs.ActiveRequests() {
+				if active.URL == req.RequestURI && active.Attempts != 1 {
+					t.Errorf("%v: %v attempts", active.URL, active.Attempts)
+				}
+			}
+			return replyOK(conn, r, req)
+		})
+	defer upstream.Close()
+
+	client = newTestClient(t, newTestCache(upstream.proxy()))
+	for i := 1; i <= 3; i++ {
+		resp, body := client.do(t, fmt.Sprintf(
+			"GET http://example.com/%d HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			i))
+		expected := fmt.Sprintf("GET http://example.com/%d", i)
+		if resp.StatusCode != http.StatusOK || body != expected {
+			t.Fatalf("unexpected reply %v %q", resp.Status, body)
+		}
+	}
+	client.Close()
+
+	traffic := client.grs.ClientTraffic()["127.0.0.1"]
+	if traffic.Requests != 3 || traffic.Status["2xx"] != 3 {
+		t.Fatalf("unexpected client traffic %+v", traffic)
+	}
+	// upstream connection is reused for all requests
+	for _, r := range upstream.seen() {
+		if r.conn != 1 {
+			t.Fatalf("request %v came on connection %d", r.url, r.conn)
+		}
+	}
+}
+
+func TestUpstreamIdleTimeout(t *testing.T) {
+	defer func(d time.Duration) { upstreamIdleTimeout = d }(
+		upstreamIdleTimeout)
+	upstreamIdleTimeout = 50 * time.Millisecond
+
+	closed := make(chan struct{})
+	upstream := newTestUpstream(t,
+		func(conn net.Conn, r *bufio.Reader, req *http.Request) bool {
+			replyOK(conn, r, req)
+			if req.RequestURI == "http://example.com/1" {
+				// idle connection is closed by dynproxy
+				r.ReadByte()
+				close(closed)
+			}
+			return false
+		})
+	defer upstream.Close()
+
+	client := newTestClient(t, newTestCache(upstream.proxy()))
+	defer client.Close()
+	client.do(t, "GET http://example.com/1 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("idle upstream connection is not closed")
+	}
+	resp, _ := client.do(
+		t, "GET http://example.com/2 HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %v", resp.Status)
+	}
+	if seen := upstream.seen(); len(seen) != 2 || seen[1].conn != 2 {
+		t.Fatalf("unexpected upstream requests %v", seen)
+	}
+}
+
+func TestConnectAfterKeepAlive(t *testing.T) {
+	upstream := newTestUpstream(t,
+		func(conn net.Conn, r *bufio.Reader, req *http.Request) bool {
+			if req.Method != "CONNECT" {
+				return replyOK(conn, r, req)
+			}
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			io.Copy(conn, r)
+			return false
+		})
+	defer upstream.Close()
+
+	client := newTestClient(t, newTestCache(upstream.proxy()))
+	defer client.Close()
+	client.do(t, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+
+	io.WriteString(client.conn,
+		"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n")
+	resp, err := http.ReadResponse(
+		client.reader, &http.Request{Method: "CONNECT"})
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("tunnel is not opened: %v %v", resp, err)
+	}
+	if proxy := upstream.proxy(); resp.Header.Get(PROXY_HEADER) != proxy.Name() {
+		t.Fatalf("unexpected headers %v", resp.Header)
+	}
+	// raw bytes pass through tunnel both ways
+	io.WriteString(client.conn, "\x16\x03\x01ping")
+	client.conn.(*net.TCPConn).CloseWrite()
+	data, err := ioutil.ReadAll(client.reader)
+	if err != nil || string(data) != "\x16\x03\x01ping" {
+		t.Fatalf("unexpected tunnel data %q: %v", data, err)
+	}
+	if seen := upstream.seen(); seen[1].method != "CONNECT" ||
+		seen[1].url != "example.com:443" {
+		t.Fatalf("unexpected upstream requests %v", seen)
+	}
+}
+
+func TestRetryOnAnotherProxy(t *testing.T) {
+	// proxy refusing connections
+	dead := proxy_cache.Proxy{Addr: "127.0.0.1:1", Scheme: proxy_cache.SchemeHTTP}
+	// proxy closing connection without reply
+	broken := newTestUpstream(t,
+		func(conn net.Conn, r *bufio.Reader, req *http.Request) bool {
+			return false
+		})
+	defer broken.Close()
+	good := newTestUpstream(t, replyOK)
+	defer good.Close()
+	goodProxy, brokenProxy := good.proxy(), broken.proxy()
+
+	cases := []struct {
+		request  string
+		status   int
+		attempts string // expected ATTEMPTS_HEADER
+	}{
+		{
+			request: "GET http://example.com/ HTTP/1.1\r\n" +
+				"Host: example.com\r\n\r\n",
+			status: http.StatusOK,
+			attempts: dead.Name() + ", " + brokenProxy.Name() + ", " +
+				goodProxy.Name(),
+		},
+		{
+			// request may be processed by proxy, so it is not sent again
+			request: "POST http://example.com/ HTTP/1.1\r\n" +
+				"Host: example.com\r\nContent-Length: 2\r\n\r\nhi",
+			status:   http.StatusBadGateway,
+			attempts: dead.Name() + ", " + brokenProxy.Name(),
+		},
+	}
+	for _, c := range cases {
+		pCache := newTestCache(dead, brokenProxy, goodProxy)
+		client := newTestClient(t, pCache)
+		resp, _ := client.do(t, c.request)
+		client.Close()
+		if resp.StatusCode != c.status ||
+			resp.Header.Get(ATTEMPTS_HEADER) != c.attempts {
+			t.Fatalf("unexpected reply %v %v", resp.Status, resp.Header)
+		}
+		if pCache.failures[dead.Addr] != 1 ||
+			pCache.failures[brokenProxy.Addr] != 1 {
+			t.Fatalf("failures are not reported: %v", pCache.failures)
+		}
+	}
+	if seen := good.seen(); len(seen) != 1 || seen[0].method != "GET" {
+		t.Fatalf("unexpected requests of good proxy %v", seen)
+	}
+	if seen := broken.seen(); len(seen) != 2 || seen[1].body != "hi" {
+		t.Fatalf("unexpected requests of broken proxy %v", seen)
+	}
+}
+
+func TestOverridePolicy(t *testing.T) {
+	defer func(policy string) { overridePolicy = policy }(overridePolicy)
+	upstream := newTestUpstream(t, replyOK)
+	defer upstream.Close()
+	proxy := upstream.proxy()
+
+	cases := []struct {
+		policy   string
+		override string
+		bad      bool // proxy is in bad state
+		status   int
+	}{
+		{overrideKnown, proxy.Addr, false, http.StatusOK},
+		{overrideKnown, "127.0.0.1:1", false, http.StatusForbidden},
+		{overrideGood, proxy.Addr, false, http.StatusOK},
+		{overrideGood, proxy.Addr, true, http.StatusForbidden},
+		{overrideAny, proxy.Addr, true, http.StatusOK},
+	}
+	for _, c := range cases {
+		overridePolicy = c.policy
+		pCache := newTestCache(proxy)
+		pCache.bad[proxy.Addr] = c.bad
+		client := newTestClient(t, pCache)
+		resp, _ := client.do(t, "GET http://example.com/ HTTP/1.1\r\n"+
+			"Host: example.com\r\n"+PROXY_HEADER+": "+c.override+"\r\n\r\n")
+		client.Close()
+		if resp.StatusCode != c.status {
+			t.Fatalf("%v %v bad=%v: unexpected status %v",
+				c.policy, c.override, c.bad, resp.Status)
+		}
+	}
+	// only allowed requests reach proxy, without override header
+	seen := upstream.seen()
+	if len(seen) != 3 {
+		t.Fatalf("unexpected upstream requests %v", seen)
+	}
+	for _, r := range seen {
+		if _, ok := r.header[PROXY_HEADER]; ok {
+			t.Fatalf("override header is sent upstream: %v", r.header)
+		}
+	}
+}
+
+func TestClientAuthentication(t *testing.T) {
+	defer func(u *auth.Users) { users = u }(users)
+	users = testUsers(t)
+
+	upstream := newTestUpstream(t,
+		func(conn net.Conn, r *bufio.Reader, req *http.Request) bool {
+			if req.Method == "CONNECT" {
+				io.WriteString(conn, "HTTP/1.1 200 OK\r\n\r\n")
+				return false
+			}
+			return replyOK(conn, r, req)
+		})
+	defer upstream.Close()
+	withCreds, err := proxy_cache.ParseProxy(
+		"http://u:p@" + upstream.listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n"
+	connect := "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n"
+	alice := "Proxy-Authorization: Basic " +
+		base64.StdEncoding.EncodeToString([]byte("alice:secret")) + "\r\n"
+	wrong := "Proxy-Authorization: Basic " +
+		base64.StdEncoding.EncodeToString([]byte("alice:wrong")) + "\r\n"
+	cases := []struct {
+		request  string
+		proxy    proxy_cache.Proxy
+		status   int
+		upstream string // Proxy-Authorization seen by upstream
+	}{
+		{get + "\r\n", upstream.proxy(), http.StatusProxyAuthRequired, ""},
+		{get + wrong + "\r\n", upstream.proxy(),
+			http.StatusProxyAuthRequired, ""},
+		{get + alice + "\r\n", upstream.proxy(), http.StatusOK, ""},
+		{get + alice + "\r\n", withCreds, http.StatusOK, "Basic dTpw"},
+		{connect + alice + "\r\n", upstream.proxy(), http.StatusOK, ""},
+	}
+	for i, c := range cases {
+		client := newTestClient(t, newTestCache(c.proxy))
+		io.WriteString(client.conn, c.request)
+		resp, err := http.ReadResponse(
+			client.reader, &http.Request{Method: "CONNECT"})
+		client.Close()
+		if err != nil || resp.StatusCode != c.status {
+			t.Fatalf("%d: unexpected reply %v %v", i, resp, err)
+		}
+		if c.status == http.StatusProxyAuthRequired {
+			if resp.Header.Get("Proxy-Authenticate") !=
+				`Basic realm="dynproxy"` {
+				t.Fatalf("%d: unexpected headers %v", i, resp.Header)
+			}
+			continue
+		}
+		seen := upstream.seen()
+		last := seen[len(seen)-1]
+		if last.header.Get("Proxy-Authorization") != c.upstream {
+			t.Fatalf("%d: upstream got credentials %v", i, last.header)
+		}
+	}
+	if len(upstream.seen()) != 3 {
+		t.Fatalf("unexpected upstream requests %v", upstream.seen())
+	}
+}
+
+func TestRequestTiming(t *testing.T) {
+	// Body comes later than headers
+	upstream := newTestUpstream(t,
+		func(conn net.Conn, r *bufio.Reader, req *http.Request) bool {
+			io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n")
+			time.Sleep(50 * time.Millisecond)
+			io.WriteString(conn, "ok")
+			return true
+		})
+	defer upstream.Close()
+
+	pCache := newTestCache(upstream.proxy())
+	client := newTestClient(t, pCache)
+	client.do(t, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	client.Close()
+
+	if len(pCache.timings) != 1 {
+		t.Fatalf("unexpected timings %v", pCache.timings)
+	}
+	timing := pCache.timings[0]
+	if timing.Connect <= 0 || timing.FirstByte < timing.Connect ||
+		timing.Total <= timing.FirstByte || timing.Total < 50*time.Millisecond {
+		t.Fatalf("unexpected timing %+v", timing)
+	}
+}
@@ -0,0 +1,335 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// Prometheus text format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets of durations in seconds, from 5ms to 5 minutes
+var DurationBuckets []float64 = []float64{
+	0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Set of metrics to expose together
+type Registry struct {
+	lock    sync.Mutex
+	metrics []metric
+	names   map[string]bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{names: make(map[string]bool)}
+}
+
+// Registry used by package functions
+var Default *Registry = NewRegistry()
+
+func (r *Registry) register(name string, m metric) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.names[name] {
+		panic(fmt.Sprintf("metric %v registered twice", name))
+	}
+	r.names[name] = true
+	r.metrics = append(r.metrics, m)
+}
+
+// Write all metrics in Prometheus text format in order of registration
+func (r *Registry) Write(w io.Writer) error {
+	r.lock.Lock()
+	var metrics []metric = append([]metric(nil), r.metrics...)
+	r.lock.Unlock()
+
+	var bw *bufio.Writer = bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serving metrics of registry
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.Write(w)
+	})
+}
+
+func Handler() http.Handler {
+	return Default.Handler()
+}
+
+// Values of one metric by label values
+type series struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+	lock   sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labels []string
+	// Counter value or histogram sum
+	sum float64
+	// Histogram counts per bucket, not cumulative, and total count
+	buckets []uint64
+	count   uint64
+}
+
+func newSeries(name, help, kind string, labels []string) *series {
+	return &series{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]*value),
+	}
+}
+
+// Find value by label values. Caller must hold s.lock.
+func (s *series) get(labels []string, buckets int) *value {
+	if len(labels) != len(s.labels) {
+		panic(fmt.Sprintf(
+			"metric %v needs %d labels, got %d",
+			s.name, len(s.labels), len(labels)))
+	}
+	key := strings.Join(labels, "\xff")
+	v, ok := s.values[key]
+	if !ok {
+		v = &value{
+			labels:  append([]string(nil), labels...),
+			buckets: make([]uint64, buckets),
+		}
+		s.values[key] = v
+	}
+	return v
+}
+
+// Values sorted by labels. Caller must hold s.lock.
+func (s *series) sorted() []*value {
+	var keys []string
+	for key := range s.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var values []*value = make([]*value, len(keys))
+	for i, key := range keys {
+		values[i] = s.values[key]
+	}
+	return values
+}
+
+func (s *series) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", s.name, escapeHelp(s.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", s.name, s.kind)
+}
+
+// Counter that only goes up
+type Counter struct {
+	s *series
+}
+
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{newSeries(name, help, "counter", labels)}
+	r.register(name, c)
+	return c
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return Default.NewCounter(name, help, labels...)
+}
+
+// Add delta to counter with label values given in order of label names
+func (c *Counter) Add(delta float64, labels ...string) {
+	c.s.lock.Lock()
+	c.s.get(labels, 0).sum += delta
+	c.s.lock.Unlock()
+}
+
+func (c *Counter) Inc(labels ...string) {
+	c.Add(1, labels...)
+}
+
+func (c *Counter) write(w *bufio.Writer) {
+	c.s.lock.Lock()
+	defer c.s.lock.Unlock()
+	c.s.writeHeader(w)
+	for _, v := range c.s.sorted() {
+		writeSample(w, c.s.name, c.s.labels, v.labels, "", "", v.sum)
+	}
+}
+
+// Histogram of observed values
+type Histogram struct {
+	s       *series
+	buckets []float64 // upper bounds, sorted
+}
+
+func (r *Registry) NewHistogram(
+	name, help string, buckets []float64, labels ...string,
+) *Histogram {
+	var sorted []float64 = append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	h := &Histogram{newSeries(name, help, "histogram", labels), sorted}
+	r.register(name, h)
+	return h
+}
+
+func NewHistogram(
+	name, help string, buckets []float64, labels ...string,
+) *Histogram {
+	return Default.NewHistogram(name, help, buckets, labels...)
+}
+
+func (h *Histogram) Observe(x float64, labels ...string) {
+	i := sort.SearchFloat64s(h.buckets, x)
+	h.s.lock.Lock()
+	v := h.s.get(labels, len(h.buckets))
+	if i < len(h.buckets) {
+		v.buckets[i]++
+	}
+	v.count++
+	v.sum += x
+	h.s.lock.Unlock()
+}
+
+func (h *Histogram) write(w *bufio.Writer) {
+	h.s.lock.Lock()
+	defer h.s.lock.Unlock()
+	h.s.writeHeader(w)
+	for _, v := range h.s.sorted() {
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += v.buckets[i]
+			writeSample(
+				w, h.s.name+"_bucket", h.s.labels, v.labels,
+				"le", formatFloat(bound), float64(cumulative))
+		}
+		writeSample(
+			w, h.s.name+"_bucket", h.s.labels, v.labels,
+			"le", "+Inf", float64(v.count))
+		writeSample(w, h.s.name+"_sum", h.s.labels, v.labels, "", "", v.sum)
+		writeSample(
+			w, h.s.name+"_count", h.s.labels, v.labels, "", "",
+			float64(v.count))
+	}
+}
+
+// Gauge read from callback on every scrape. Callback returns values by
+// value of the only label, or by empty string if gauge has no label.
+type gaugeFunc struct {
+	s *series
+	f func() map[string]float64
+}
+
+// Register gauge without labels
+func (r *Registry) NewGaugeFunc(name, help string, f func() float64) {
+	r.register(name, &gaugeFunc{
+		newSeries(name, help, "gauge", nil),
+		func() map[string]float64 { return map[string]float64{"": f()} },
+	})
+}
+
+func NewGaugeFunc(name, help string, f func() float64) {
+	Default.NewGaugeFunc(name, help, f)
+}
+
+// Register gauge with one label
+func (r *Registry) NewGaugeVecFunc(
+	name, help, label string, f func() map[string]float64,
+) {
+	r.register(name, &gaugeFunc{
+		newSeries(name, help, "gauge", []string{label}), f})
+}
+
+func NewGaugeVecFunc(
+	name, help, label string, f func() map[string]float64,
+) {
+	Default.NewGaugeVecFunc(name, help, label, f)
+}
+
+func (g *gaugeFunc) write(w *bufio.Writer) {
+	values := g.f()
+	var keys []string
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	g.s.writeHeader(w)
+	for _, key := range keys {
+		var labels []string
+		if len(g.s.labels) > 0 {
+			labels = []string{key}
+		}
+		writeSample(w, g.s.name, g.s.labels, labels, "", "", values[key])
+	}
+}
+
+// Write one sample line. Extra label like "le" is added after others if
+// its name is not empty.
+func writeSample(
+	w *bufio.Writer, name string, names, values []string,
+	extraName, extraValue string, x float64,
+) {
+	w.WriteString(name)
+	if len(names) > 0 || extraName != "" {
+		w.WriteByte('{')
+		for i := range names {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, names[i], escapeLabel(values[i]))
+		}
+		if extraName != "" {
+			if len(names) > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, extraName, extraValue)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(x))
+	w.WriteByte('\n')
+}
+
+func formatFloat(x float64) string {
+	switch {
+	case math.IsInf(x, 1):
+		return "+Inf"
+	case math.IsInf(x, -1):
+		return "-Inf"
+	case math.IsNaN(x):
+		return "NaN"
+	}
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+var labelEscaper *strings.Replacer = strings.NewReplacer(
+	`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var helpEscaper *strings.Replacer = strings.NewReplacer(
+	`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
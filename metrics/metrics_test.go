@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounter("requests_total", "Requests.", "proxy", "code")
+	requests.Inc("b:80", "200")
+	requests.Add(2, "a:80", "200")
+	requests.Inc(`q"\`+"\n", "500")
+	latency := r.NewHistogram(
+		"latency_seconds", "Latency\nin seconds.", []float64{1, 0.1})
+	latency.Observe(0.05)
+	latency.Observe(0.1)
+	latency.Observe(3)
+	r.NewGaugeFunc("up", "Up.", func() float64 { return 1 })
+	r.NewGaugeVecFunc(
+		"proxies", "Proxies.", "state",
+		func() map[string]float64 { return map[string]float64{"good": 2} })
+
+	var out bytes.Buffer
+	if err := r.Write(&out); err != nil {
+		t.Fatal(err)
+	}
+	expected := `# HELP requests_total Requests.
+# TYPE requests_total counter
+requests_total{proxy="a:80",code="200"} 2
+requests_total{proxy="b:80",code="200"} 1
+requests_total{proxy="q\"\\\n",code="500"} 1
+# HELP latency_seconds Latency\nin seconds.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 3.15
+latency_seconds_count 3
+# HELP up Up.
+# TYPE up gauge
+up 1
+# HELP proxies Proxies.
+# TYPE proxies gauge
+proxies{state="good"} 2
+`
+	if out.String() != expected {
+		t.Fatalf("unexpected output:\n%v", out.String())
+	}
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") ||
+		w.Body.String() != expected {
+		t.Fatal("unexpected reply of handler")
+	}
+}
+
+func TestRegisterTwice(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("c", "C.")
+	defer func() {
+		if recover() == nil {
+			t.Fatal("second registration should panic")
+		}
+	}()
+	r.NewCounter("c", "C.")
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"github.com/olomix/dynproxy/metrics"
+	"github.com/olomix/dynproxy/proxy_cache"
+	"github.com/olomix/dynproxy/stats"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Kinds of client requests in metrics
+const (
+	requestKindHTTP    = "http"
+	requestKindConnect = "connect"
+	requestKindSOCKS   = "socks"
+)
+
+// Directions of traffic in metrics
+const (
+	directionUpstream   = "upstream"   // from client to proxy
+	directionDownstream = "downstream" // from proxy to client
+)
+
+var requestDuration *metrics.Histogram = metrics.NewHistogram(
+	"dynproxy_request_duration_seconds",
+	"Time to serve client request, whole tunnel for CONNECT and SOCKS.",
+	metrics.DurationBuckets, "kind")
+
+var bytesTotal *metrics.Counter = metrics.NewCounter(
+	"dynproxy_bytes_total",
+	"Bytes transferred between clients and proxies.",
+	"direction")
+
+// Writer counting bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Types of failed requests in traffic stats besides error classes of proxy
+// cache
+const (
+	errorTypeAuth       = "auth"        // client failed authentication
+	errorTypeDenied     = "denied"      // not allowed by policy of client
+	errorTypeNoProxy    = "no_proxy"    // no proxy to serve request
+	errorTypeBadRequest = "bad_request" // malformed request of client
+	errorTypeClient     = "client"      // error on reading from or writing to client
+)
+
+// Traffic of one client request. Every attempt is counted for its proxy,
+// and the whole request for client when it is done.
+type requestTraffic struct {
+	grs    *stats.GoRoutineStats
+	client string
+	proxy  string // proxy of current attempt, empty if none
+	// Bytes of current attempt and bytes of client not related to it
+	in, out             int64
+	clientIn, clientOut int64
+	status              int    // status of reply to client, 0 if none
+	errType             string // empty if request did not fail
+}
+
+func newRequestTraffic(
+	grs *stats.GoRoutineStats, addr net.Addr,
+) *requestTraffic {
+	var client string = addr.String()
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+	return &requestTraffic{grs: grs, client: client}
+}
+
+// Count client by user name instead of IP if client is authenticated
+func (t *requestTraffic) setUser(user string) {
+	if user != "" {
+		t.client = user
+	}
+}
+
+func (t *requestTraffic) attempt(proxy string) {
+	t.proxy, t.errType = proxy, ""
+}
+
+// Count failed attempt for its proxy. Error is kept for client unless
+// next attempt succeeds.
+func (t *requestTraffic) attemptFailed(err error) {
+	if dialErr, ok := err.(dialError); ok {
+		err = dialErr.error
+	}
+	t.errType = proxy_cache.ClassifyError(err)
+	t.grs.AddProxyTraffic(
+		t.proxy, stats.RequestTraffic(t.in, t.out, 0, t.errType))
+	t.clientIn += t.in
+	t.clientOut += t.out
+	t.proxy, t.in, t.out = "", 0, 0
+}
+
+func (t *requestTraffic) fail(errType string) {
+	t.errType = errType
+}
+
+// Reply to client with error, bytes of reply are not counted for proxy.
+func (t *requestTraffic) writeError(
+	w io.Writer, status int, header http.Header,
+) {
+	var cw *countingWriter = &countingWriter{w: w}
+	writeError(cw, status, header)
+	t.status = status
+	t.clientIn += cw.n
+}
+
+// Add traffic of request to stats
+func (t *requestTraffic) done() {
+	if t.proxy != "" {
+		// failure of client is not counted against proxy
+		var errType string = t.errType
+		if errType == errorTypeClient {
+			errType = ""
+		}
+		t.grs.AddProxyTraffic(
+			t.proxy, stats.RequestTraffic(t.in, t.out, t.status, errType))
+	}
+	t.grs.AddClientTraffic(
+		t.client,
+		stats.RequestTraffic(
+			t.clientIn+t.in, t.clientOut+t.out, t.status, t.errType))
+}
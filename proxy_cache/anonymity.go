@@ -0,0 +1,176 @@
+package proxy_cache
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/olomix/dynproxy/log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Path of check server endpoint which echoes request headers back
+const CheckEchoPath = "/dynproxy/echo"
+
+// Failed discovery of real IP is retried after this time
+const realIPRetryInterval = time.Minute
+
+var checkRealIP string
+
+func init() {
+	flag.StringVar(
+		&checkRealIP,
+		"check-real-ip", "",
+		"public IP of dynproxy host for anonymity check, "+
+			"asked from echo endpoint if empty")
+}
+
+// Reply of echo endpoint
+type echoReply struct {
+	RemoteAddr string      `json:"remote_addr"`
+	Header     http.Header `json:"header"`
+}
+
+// Headers which reveal request came through proxy
+var proxyHeaders = []string{
+	"Via", "X-Forwarded-For", "Forwarded", "X-Real-Ip", "X-Proxy-Id",
+	"Client-Ip", "X-Client-Ip", "X-Originating-Ip",
+}
+
+// Request echo endpoint through proxy and classify proxy by headers
+// target received. Proxy is transparent if real IP leaked, anonymous if
+// it added proxy headers and elite otherwise. While real IP is unknown
+// leaking proxy can't be told from others, so anonymity is not reported.
+type AnonymityChecker struct {
+	URL     string
+	RealIP  string // asked from echo endpoint directly if empty
+	Timeout time.Duration
+
+	realIPLock sync.Mutex
+	realIPTry  time.Time // last failed discovery of real IP
+}
+
+func (c *AnonymityChecker) Check(proxy *Proxy) CheckResult {
+	realIP := c.realIP()
+
+	var start time.Time = time.Now()
+	reply, err := getEcho(proxyClient(proxy, c.Timeout), c.URL)
+	if err != nil {
+		return failedCheck(ClassifyError(err), err)
+	}
+	var result CheckResult = CheckResult{
+		OK:       true,
+		Timing:   Timing{Total: time.Since(start)},
+		Features: []string{FeatureHTTP},
+	}
+	if realIP != "" {
+		result.Anonymity = classifyAnonymity(reply.Header, realIP)
+	}
+	return result
+}
+
+// Return real IP of dynproxy host, empty if it is unknown. IP is asked
+// from echo endpoint directly, failed discovery is retried after
+// realIPRetryInterval.
+func (c *AnonymityChecker) realIP() string {
+	c.realIPLock.Lock()
+	defer c.realIPLock.Unlock()
+	if c.RealIP != "" || time.Since(c.realIPTry) < realIPRetryInterval {
+		return c.RealIP
+	}
+	var client *http.Client = &http.Client{Timeout: c.Timeout}
+	reply, err := getEcho(client, c.URL)
+	if err != nil {
+		log.Errorf("Can't get real IP from %v: %v", c.URL, err)
+		c.realIPTry = time.Now()
+		return ""
+	}
+	host, _, err := net.SplitHostPort(reply.RemoteAddr)
+	if err != nil {
+		log.Errorf("Bad remote address from %v: %v", c.URL, err)
+		c.realIPTry = time.Now()
+		return ""
+	}
+	c.RealIP = host
+	return c.RealIP
+}
+
+func getEcho(client *http.Client, echoURL string) (*echoReply, error) {
+	req, err := http.NewRequest("GET", echoURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Cache-Control", "no-cache")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	var reply *echoReply = new(echoReply)
+	if err = json.NewDecoder(resp.Body).Decode(reply); err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+func classifyAnonymity(header http.Header, realIP string) string {
+	if realIP != "" {
+		for _, values := range header {
+			for _, v := range values {
+				if containsIP(v, realIP) {
+					return AnonymityTransparent
+				}
+			}
+		}
+	}
+	for _, name := range proxyHeaders {
+		if header.Get(name) != "" {
+			return AnonymityAnonymous
+		}
+	}
+	return AnonymityElite
+}
+
+// Return true if header value has IP among its tokens, like in
+// "for=1.2.3.4, 5.6.7.8" or "[::1]:80".
+func containsIP(value, ip string) bool {
+	tokens := strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ';' || r == '=' || r == ' ' || r == '"'
+	})
+	for _, token := range tokens {
+		if host, _, err := net.SplitHostPort(token); err == nil {
+			token = host
+		}
+		token = strings.Trim(token, "[]")
+		if token == ip {
+			return true
+		}
+	}
+	return false
+}
+
+// URL of echo endpoint on host of check URL
+func echoURLOf(checkURL string) (string, error) {
+	u, err := url.Parse(checkURL)
+	if err != nil {
+		return "", err
+	}
+	return (&url.URL{Scheme: u.Scheme, Host: u.Host, Path: CheckEchoPath}).
+		String(), nil
+}
+
+func serveEcho(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	json.NewEncoder(w).Encode(echoReply{
+		RemoteAddr: r.RemoteAddr,
+		Header:     r.Header,
+	})
+}
@@ -0,0 +1,127 @@
+package proxy_cache
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Forward HTTP proxy adding headers to requests
+func newHeaderProxy(header http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			out, _ := http.NewRequest(r.Method, r.URL.String(), nil)
+			for name, values := range header {
+				out.Header[name] = values
+			}
+			resp, err := http.DefaultTransport.RoundTrip(out)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}))
+}
+
+func TestAnonymityChecker(t *testing.T) {
+	target := httptest.NewServer(CheckHandler())
+	defer target.Close()
+	echoURL, err := echoURLOf(target.URL + "/t.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &AnonymityChecker{URL: echoURL, Timeout: 5 * time.Second}
+
+	cases := []struct {
+		header    http.Header
+		anonymity string
+	}{
+		{http.Header{}, AnonymityElite},
+		{http.Header{"Via": {"1.1 squid"}}, AnonymityAnonymous},
+		{http.Header{"X-Forwarded-For": {"10.0.0.1, 127.0.0.1"}}, AnonymityTransparent},
+		{http.Header{"X-Forwarded-For": {"127.0.0.10"}}, AnonymityAnonymous},
+	}
+	for _, tc := range cases {
+		server := newHeaderProxy(tc.header)
+		proxy := &Proxy{Addr: server.Listener.Addr().String(), Scheme: SchemeHTTP}
+		r := c.Check(proxy)
+		server.Close()
+		if !r.OK || r.Anonymity != tc.anonymity {
+			t.Fatalf("%v: result = %+v", tc.header, r)
+		}
+	}
+	if c.RealIP != "127.0.0.1" {
+		t.Fatalf("real IP = %v", c.RealIP)
+	}
+}
+
+func TestAnonymityPool(t *testing.T) {
+	proxy := &Proxy{Addr: "one", Scheme: SchemeHTTP}
+	cc := newTestCache(proxy)
+	elite := []string{anonymityTagPrefix + AnonymityElite}
+
+	if _, err := cc.NextProxyInPool(elite); err == nil {
+		t.Fatal("proxy of unknown anonymity in elite pool")
+	}
+	cc.setAnonymity(proxy, AnonymityElite)
+	if p, err := cc.NextProxyInPool(elite); err != nil || p.Addr != "one" {
+		t.Fatalf("proxy %v: %v", p.Addr, err)
+	}
+	cc.setAnonymity(proxy, AnonymityTransparent)
+	if _, err := cc.NextProxyInPool(elite); err == nil {
+		t.Fatal("transparent proxy in elite pool")
+	}
+	if !cc.IsGood("one") {
+		t.Fatal("proxy left good list")
+	}
+}
+
+func TestAnonymityUnknownRealIP(t *testing.T) {
+	var (
+		lock    sync.Mutex
+		failing bool = true
+	)
+	// Echo endpoint fails for direct requests while failing is set
+	handler := CheckHandler()
+	target := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			lock.Lock()
+			fail := failing && r.Header.Get("Via") == ""
+			lock.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			handler.ServeHTTP(w, r)
+		}))
+	defer target.Close()
+	echoURL, err := echoURLOf(target.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newHeaderProxy(http.Header{
+		"Via": {"1.1 squid"}, "X-Forwarded-For": {"127.0.0.1"}})
+	defer server.Close()
+	proxy := &Proxy{Addr: server.Listener.Addr().String(), Scheme: SchemeHTTP}
+	c := &AnonymityChecker{URL: echoURL, Timeout: 5 * time.Second}
+
+	// leaking proxy is not reported as anonymous without real IP
+	if r := c.Check(proxy); !r.OK || r.Anonymity != "" {
+		t.Fatalf("result = %+v", r)
+	}
+	lock.Lock()
+	failing = false
+	lock.Unlock()
+	if r := c.Check(proxy); r.Anonymity != "" {
+		t.Fatalf("real IP asked again too soon: %+v", r)
+	}
+	c.realIPTry = time.Now().Add(-realIPRetryInterval)
+	if r := c.Check(proxy); r.Anonymity != AnonymityTransparent {
+		t.Fatalf("result = %+v", r)
+	}
+}
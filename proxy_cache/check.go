@@ -0,0 +1,309 @@
+package proxy_cache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/olomix/dynproxy/log"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Kinds of proxy checks
+const (
+	CheckHTTP    = "http"
+	CheckConnect = "connect"
+	CheckTCP     = "tcp"
+	// Request echo endpoint and classify anonymity of proxy
+	CheckAnonymity = "anonymity"
+)
+
+// Classes of check errors
+const (
+	ErrorClassDial    = "dial"
+	ErrorClassTimeout = "timeout"
+	ErrorClassTLS     = "tls"
+	ErrorClassProxy   = "proxy"
+	ErrorClassStatus  = "status"
+	ErrorClassBody    = "body"
+)
+
+// Features of proxy detected by checks
+const (
+	FeatureHTTP    = "http"    // proxies plain HTTP requests
+	FeatureConnect = "connect" // opens tunnels to TLS hosts
+)
+
+var checkKinds string
+var checkConnectTarget string
+
+func init() {
+	flag.StringVar(
+		&checkKinds,
+		"check-kinds", CheckHTTP,
+		fmt.Sprintf(
+			"comma separated checks proxy must pass: %v, %v, %v or %v",
+			CheckHTTP, CheckConnect, CheckTCP, CheckAnonymity))
+	flag.StringVar(
+		&checkConnectTarget,
+		"check-connect-target", "",
+		"host:port of TLS server to open tunnel to in connect check, "+
+			"host of -check-url with port 443 if empty")
+}
+
+// Result of proxy check
+type CheckResult struct {
+	OK     bool
+	Timing Timing
+	// One of ErrorClass constants if check failed
+	ErrorClass string
+	Err        error
+	// Features of proxy confirmed by check
+	Features []string
+	// One of Anonymity constants if check detected it
+	Anonymity string
+}
+
+// Checker decides if proxy is good. Check may be called concurrently.
+type Checker interface {
+	Check(proxy *Proxy) CheckResult
+}
+
+// Build checker from comma separated list of check kinds. Proxy must pass
+// all of them.
+func NewChecker(
+	kinds string, target *CheckTarget, connectTarget string,
+) (Checker, error) {
+	var checkers AllChecker
+	for _, kind := range strings.Split(kinds, ",") {
+		switch strings.TrimSpace(kind) {
+		case CheckHTTP:
+			checkers = append(checkers, &HTTPChecker{Target: target})
+		case CheckConnect:
+			if connectTarget == "" {
+				u, err := url.Parse(target.URL)
+				if err != nil {
+					return nil, err
+				}
+				connectTarget = net.JoinHostPort(u.Hostname(), "443")
+			}
+			checkers = append(checkers, &ConnectChecker{
+				Target: connectTarget, Timeout: target.Timeout})
+		case CheckTCP:
+			checkers = append(checkers, &TCPChecker{Timeout: target.Timeout})
+		case CheckAnonymity:
+			echoURL, err := echoURLOf(target.URL)
+			if err != nil {
+				return nil, err
+			}
+			checkers = append(checkers, &AnonymityChecker{
+				URL: echoURL, RealIP: checkRealIP, Timeout: target.Timeout})
+		default:
+			return nil, fmt.Errorf("unknown check kind %v", kind)
+		}
+	}
+	if len(checkers) == 1 {
+		return checkers[0], nil
+	}
+	return checkers, nil
+}
+
+// Checker configured with flags
+func checkerFromFlags() (Checker, error) {
+	target, err := checkTargetFromFlags()
+	if err != nil {
+		return nil, err
+	}
+	return NewChecker(checkKinds, target, checkConnectTarget)
+}
+
+// Request check target through proxy and match reply.
+type HTTPChecker struct {
+	Target *CheckTarget
+}
+
+// HTTP client sending all requests through proxy
+func proxyClient(proxy *Proxy, timeout time.Duration) *http.Client {
+	var transport *http.Transport = &http.Transport{DisableKeepAlives: true}
+	if proxy.IsHTTP() {
+		transport.Proxy = http.ProxyURL(proxy.proxyURL())
+	} else {
+		transport.DialContext = func(
+			ctx context.Context, network, addr string,
+		) (net.Conn, error) {
+			return proxy.DialTunnel(addr, timeout)
+		}
+	}
+	return &http.Client{Transport: transport, Timeout: timeout}
+}
+
+func (c *HTTPChecker) Check(proxy *Proxy) CheckResult {
+	client := proxyClient(proxy, c.Target.Timeout)
+
+	req, err := http.NewRequest("GET", c.Target.URL, nil)
+	if err != nil {
+		return failedCheck(ErrorClassProxy, err)
+	}
+	req.Header.Add("Cache-Control", "no-cache")
+	req.Header.Add("Proxy-Connection", "Keep-Alive")
+
+	var (
+		start  time.Time = time.Now()
+		timing Timing
+	)
+	req = req.WithContext(httptrace.WithClientTrace(
+		req.Context(), &httptrace.ClientTrace{
+			GotConn: func(httptrace.GotConnInfo) {
+				timing.Connect = time.Since(start)
+			},
+			GotFirstResponseByte: func() {
+				timing.FirstByte = time.Since(start)
+			},
+		}))
+	resp, err := client.Do(req)
+	if err != nil {
+		log.Debugf("Proxy request failed %v: %v", proxy.Name(), err)
+		return failedCheck(ClassifyError(err), err)
+	}
+	defer resp.Body.Close()
+
+	out, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		log.Debugf("Can't read from proxy %v: %v", proxy.Name(), err)
+		return failedCheck(ClassifyError(err), err)
+	}
+	if !c.Target.matchesStatus(resp.StatusCode) {
+		return failedCheck(
+			ErrorClassStatus,
+			fmt.Errorf("unexpected status %v", resp.Status))
+	}
+	if !c.Target.matchesBody(out) {
+		return failedCheck(ErrorClassBody, errors.New("unexpected body"))
+	}
+	timing.Total = time.Since(start)
+	return CheckResult{
+		OK:       true,
+		Timing:   timing,
+		Features: []string{FeatureHTTP},
+	}
+}
+
+// Open tunnel through proxy to TLS server and complete TLS handshake with
+// it. HTTP proxies are asked with CONNECT method.
+type ConnectChecker struct {
+	Target  string // host:port
+	Timeout time.Duration
+}
+
+func (c *ConnectChecker) Check(proxy *Proxy) CheckResult {
+	var start time.Time = time.Now()
+	conn, err := proxy.DialTunnel(c.Target, c.Timeout)
+	if err != nil {
+		return failedCheck(ClassifyError(err), err)
+	}
+	defer conn.Close()
+	var timing Timing = Timing{Connect: time.Since(start)}
+
+	host, _, _ := net.SplitHostPort(c.Target)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	tlsConn.SetDeadline(start.Add(c.Timeout))
+	if err = tlsConn.Handshake(); err != nil {
+		return failedCheck(ClassifyError(err), err)
+	}
+	timing.Total = time.Since(start)
+	return CheckResult{
+		OK:       true,
+		Timing:   timing,
+		Features: []string{FeatureConnect},
+	}
+}
+
+// Only connect to proxy port
+type TCPChecker struct {
+	Timeout time.Duration
+}
+
+func (c *TCPChecker) Check(proxy *Proxy) CheckResult {
+	var start time.Time = time.Now()
+	conn, err := net.DialTimeout("tcp", proxy.Addr, c.Timeout)
+	if err != nil {
+		return failedCheck(ClassifyError(err), err)
+	}
+	conn.Close()
+	var connect time.Duration = time.Since(start)
+	return CheckResult{
+		OK:     true,
+		Timing: Timing{Connect: connect, Total: connect},
+	}
+}
+
+// Proxy is good if it passes all checks. Checks run in order and stop on
+// first failure. Each timing is the largest of checks.
+type AllChecker []Checker
+
+func (c AllChecker) Check(proxy *Proxy) CheckResult {
+	var result CheckResult = CheckResult{OK: true}
+	for _, checker := range c {
+		r := checker.Check(proxy)
+		if !r.OK {
+			return r
+		}
+		result.Timing = maxTiming(result.Timing, r.Timing)
+		result.Features = append(result.Features, r.Features...)
+		if r.Anonymity != "" {
+			result.Anonymity = r.Anonymity
+		}
+	}
+	return result
+}
+
+func maxTiming(a, b Timing) Timing {
+	if b.Connect > a.Connect {
+		a.Connect = b.Connect
+	}
+	if b.FirstByte > a.FirstByte {
+		a.FirstByte = b.FirstByte
+	}
+	if b.Total > a.Total {
+		a.Total = b.Total
+	}
+	return a
+}
+
+func failedCheck(class string, err error) CheckResult {
+	return CheckResult{ErrorClass: class, Err: err}
+}
+
+// Sort check error into one of ErrorClass constants
+func ClassifyError(err error) string {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return ErrorClassTimeout
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "proxyconnect" {
+		// net/http wraps error of connecting to HTTP proxy
+		errors.As(opErr.Err, &opErr)
+	}
+	if opErr != nil && opErr.Op == "dial" {
+		return ErrorClassDial
+	}
+	var (
+		recordErr tls.RecordHeaderError
+		certErr   x509.CertificateInvalidError
+		hostErr   x509.HostnameError
+		authErr   x509.UnknownAuthorityError
+	)
+	if errors.As(err, &recordErr) || errors.As(err, &certErr) ||
+		errors.As(err, &hostErr) || errors.As(err, &authErr) {
+		return ErrorClassTLS
+	}
+	return ErrorClassProxy
+}
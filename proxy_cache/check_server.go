@@ -0,0 +1,41 @@
+package proxy_cache
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// Handler of canary endpoint requested by proxy checks. It replies with
+// expected check body to any GET request, so dynproxy instance may serve
+// as check target for itself or for other instances. Requests to
+// CheckEchoPath get headers they came with.
+func CheckHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == CheckEchoPath {
+			serveEcho(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-cache, no-store")
+		fmt.Fprintln(w, checkBody)
+	})
+}
+
+// Return error if check target can't be served with check flags. With
+// regex match check body is a pattern and served as is it would not match.
+func CheckServerError() error {
+	if checkMatch == MatchRegexp {
+		return fmt.Errorf(
+			"check target can't be served with -check-match %v", MatchRegexp)
+	}
+	return nil
+}
+
+// Serve canary endpoint on address. Blocks until server fails.
+func ServeCheckTarget(address string) error {
+	return http.ListenAndServe(address, CheckHandler())
+}
@@ -0,0 +1,114 @@
+package proxy_cache
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Ways to match body of check reply
+const (
+	MatchExact     = "exact"
+	MatchSubstring = "substring"
+	MatchRegexp    = "regex"
+)
+
+const defaultCheckURL = "http://lomaka.org.ua/t.txt"
+const defaultCheckBody = "6b5f2815-5c7a-4970-99f1-8eb290564ddc"
+
+var (
+	checkURL     string
+	checkStatus  int
+	checkBody    string
+	checkMatch   string
+	checkTimeout time.Duration
+)
+
+func init() {
+	flag.StringVar(
+		&checkURL,
+		"check-url", defaultCheckURL,
+		"URL requested through proxy to check it")
+	flag.IntVar(
+		&checkStatus,
+		"check-status", http.StatusOK,
+		"expected status of check reply, 0 for any")
+	flag.StringVar(
+		&checkBody,
+		"check-body", defaultCheckBody,
+		"expected body of check reply")
+	flag.StringVar(
+		&checkMatch,
+		"check-match", MatchExact,
+		fmt.Sprintf(
+			"how to match body of check reply: %v, %v or %v",
+			MatchExact, MatchSubstring, MatchRegexp))
+	flag.DurationVar(
+		&checkTimeout,
+		"check-timeout", 60*time.Second,
+		"timeout of proxy check")
+}
+
+// What to request through proxy and what to expect in reply to consider
+// proxy good.
+type CheckTarget struct {
+	URL     string
+	Status  int // 0 for any status
+	Body    string
+	Match   string
+	Timeout time.Duration
+	re      *regexp.Regexp
+}
+
+func NewCheckTarget(
+	url string, status int, body, match string, timeout time.Duration,
+) (*CheckTarget, error) {
+	var t *CheckTarget = &CheckTarget{
+		URL:     url,
+		Status:  status,
+		Body:    body,
+		Match:   match,
+		Timeout: timeout,
+	}
+	switch match {
+	case MatchExact, MatchSubstring:
+	case MatchRegexp:
+		var err error
+		if t.re, err = regexp.Compile(body); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown body match %v", match)
+	}
+	if _, err := http.NewRequest("GET", url, nil); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Check target configured with flags
+func checkTargetFromFlags() (*CheckTarget, error) {
+	return NewCheckTarget(
+		checkURL, checkStatus, checkBody, checkMatch, checkTimeout)
+}
+
+// Return true if reply status is expected
+func (t *CheckTarget) matchesStatus(status int) bool {
+	return t.Status == 0 || status == t.Status
+}
+
+// Return true if reply body is expected. Exact match ignores surrounding
+// whitespace.
+func (t *CheckTarget) matchesBody(body []byte) bool {
+	switch t.Match {
+	case MatchSubstring:
+		return bytes.Contains(body, []byte(t.Body))
+	case MatchRegexp:
+		return t.re.Match(body)
+	default:
+		return string(bytes.TrimSpace(body)) == t.Body
+	}
+}
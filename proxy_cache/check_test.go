@@ -0,0 +1,132 @@
+package proxy_cache
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Checker with fixed result
+type fakeChecker CheckResult
+
+func (c fakeChecker) Check(proxy *Proxy) CheckResult {
+	return CheckResult(c)
+}
+
+func TestCheckProxyResult(t *testing.T) {
+	proxy := &Proxy{Addr: "one", Scheme: SchemeHTTP, failCounter: 1}
+	cc := newTestCache(proxy)
+	// proxy is out of heap while it is being checked
+	cc.proxies = cc.proxies[:0]
+
+	cc.checker = fakeChecker{OK: true, Timing: Timing{Total: time.Second}}
+	cc.checkProxy(proxy)
+	if !cc.IsGood("one") || proxy.failCounter != 0 ||
+		cc.metrics.Latency("one") != time.Second || len(cc.proxies) != 1 ||
+		len(proxy.Latency.History) != 1 {
+		t.Fatalf("proxy = %v", proxy)
+	}
+
+	cc.proxies = cc.proxies[:0]
+	cc.checker = fakeChecker{ErrorClass: ErrorClassDial}
+	cc.checkProxy(proxy)
+	if cc.IsGood("one") || proxy.failCounter != 1 {
+		t.Fatalf("proxy = %v", proxy)
+	}
+}
+
+// HTTP proxy which supports CONNECT only
+func newTestConnectProxy() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "CONNECT" {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			upstream, err := net.Dial("tcp", r.Host)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer upstream.Close()
+			w.WriteHeader(http.StatusOK)
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go io.Copy(upstream, buf)
+			io.Copy(conn, upstream)
+		}))
+}
+
+func TestConnectChecker(t *testing.T) {
+	tlsServer := httptest.NewTLSServer(http.NotFoundHandler())
+	defer tlsServer.Close()
+	plainServer := httptest.NewServer(http.NotFoundHandler())
+	defer plainServer.Close()
+	proxyServer := newTestConnectProxy()
+	defer proxyServer.Close()
+	proxy := &Proxy{
+		Addr: proxyServer.Listener.Addr().String(), Scheme: SchemeHTTP}
+
+	// certificate of test server is not trusted
+	c := &ConnectChecker{
+		Target: tlsServer.Listener.Addr().String(), Timeout: 5 * time.Second}
+	if r := c.Check(proxy); r.OK || r.ErrorClass != ErrorClassTLS {
+		t.Fatalf("result = %+v", r)
+	}
+
+	c.Target = plainServer.Listener.Addr().String()
+	if r := c.Check(proxy); r.OK {
+		t.Fatalf("result = %+v", r)
+	}
+}
+
+func TestTCPAndAllChecker(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	proxy := &Proxy{Addr: server.Listener.Addr().String(), Scheme: SchemeHTTP}
+
+	var c Checker = AllChecker{
+		&TCPChecker{Timeout: time.Second},
+		fakeChecker{OK: true, Features: []string{FeatureHTTP}},
+	}
+	r := c.Check(proxy)
+	if !r.OK || len(r.Features) != 1 || r.Features[0] != FeatureHTTP {
+		t.Fatalf("result = %+v", r)
+	}
+
+	c = AllChecker{&TCPChecker{Timeout: time.Second}, fakeChecker{}}
+	if c.Check(proxy).OK {
+		t.Fatal("all checks must pass")
+	}
+
+	server.Close()
+	r = (&TCPChecker{Timeout: time.Second}).Check(proxy)
+	if r.OK || r.ErrorClass != ErrorClassDial {
+		t.Fatalf("result = %+v", r)
+	}
+}
+
+func TestNewChecker(t *testing.T) {
+	target, err := NewCheckTarget(
+		"http://example.com/t.txt", 200, "x", MatchExact, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewChecker("http, connect,tcp", target, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, ok := c.(AllChecker)
+	if !ok || len(all) != 3 ||
+		all[1].(*ConnectChecker).Target != "example.com:443" {
+		t.Fatalf("checker = %#v", c)
+	}
+	if _, err = NewChecker("icmp", target, ""); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -1,19 +1,16 @@
 package proxy_cache
 
 import (
-	"bufio"
 	"container/heap"
+	"context"
 	"encoding/gob"
 	"fmt"
 	"github.com/olomix/dynproxy/log"
 	"github.com/olomix/dynproxy/stats"
-	"io/ioutil"
-	"net/http"
-	"net/url"
+	"io"
 	"os"
 	"sort"
 	"sync"
-	"sync/atomic"
 	"time"
 )
 
@@ -21,98 +18,183 @@ const proxyCheckPool = 100
 const proxyCheckTimeoutMin = 5 * time.Minute
 const proxyCheckTimeoutMax = 24 * time.Hour
 const autoSaveTimeout = 10 * time.Second
-const autoSaveFilename = ".dynproxy.save"
+
+// File proxies are saved to between runs
+const AutoSaveFilename = ".dynproxy.save"
 
 type ProxyCache interface {
-	Stop()
-	NextProxy() (string, error)
+	// Stop checking proxies, wait for running checks until ctx is done and
+	// save cache
+	Stop(ctx context.Context)
+	NextProxy() (Proxy, error)
+	// Return next good proxy having any of tags of pool
+	NextProxyInPool(pool []string) (Proxy, error)
+	// Find known proxy by its address
+	LookupProxy(addr string) (Proxy, bool)
+	// Return true if proxy is in good state now
+	IsGood(addr string) bool
+	// Report result of live request through proxy
+	ReportFailure(addr string)
+	ReportSuccess(addr string, timing Timing)
+	// Count requests being served by proxy. Every Acquire must be
+	// followed by Release.
+	Acquire(addr string)
+	Release(addr string)
+	// Return proxy bound to sticky session of user. Proxy is chosen from
+	// pool.
+	SessionProxy(user, session string, pool []string) (Proxy, error)
+	// Return copy of all proxies sorted by address
+	Proxies() []Proxy
+	// Read input file again and apply changes of proxy list
+	Reload() error
+	// Add proxy, false if it is known already
+	AddProxy(proxy Proxy) bool
+	// Drop proxy, false if it is unknown
+	RemoveProxy(addr string) bool
+	// Check proxy as soon as possible, false if it is unknown
+	CheckNow(addr string) bool
+	Stats() CacheStats
 }
 
 type CacheContext struct {
 	lock          sync.RWMutex
 	proxies       ProxyHeap
-	checkPoolSize *int64
+	index         map[string]*Proxy // all proxies by address
 	goodProxyList GoodProxyList
+	pools         map[string]*GoodProxyList // good proxies by tag
+	metrics       *proxyMetrics
+	sessions      *sessionTable
+	checker       Checker
+	scheduler     *scheduler
+	inFileName    string
+	sources       map[string][]*Proxy // proxies listed by every source
+	saveFileName  string              // cache is not saved if empty
+	saved         map[string]*Proxy   // saved state of proxies not listed yet
 	saveLock      sync.Mutex
 	grs           *stats.GoRoutineStats
 }
 
-func NewProxyCache(proxyFileName string, grs *stats.GoRoutineStats) ProxyCache {
+// Create cache of proxies from input file and sources and start checking
+// them. Return error if input file, sources file or check and selector
+// flags are bad.
+func NewProxyCache(
+	proxyFileName string, grs *stats.GoRoutineStats,
+) (ProxyCache, error) {
+	entries, err := readProxiesFromFile(proxyFileName)
+	if err != nil {
+		return nil, fmt.Errorf("can't read proxies: %v", err)
+	}
+	var metrics *proxyMetrics = newProxyMetrics()
+	selector, err := NewSelector(selectorName, metrics)
+	if err != nil {
+		return nil, err
+	}
+	checker, err := checkerFromFlags()
+	if err != nil {
+		return nil, fmt.Errorf("bad check flags: %v", err)
+	}
+	sources, err := ReadSources(sourcesFileName)
+	if err != nil {
+		return nil, fmt.Errorf("can't read sources: %v", err)
+	}
 	cache := &CacheContext{
-		proxies:       readProxiesFromFile(proxyFileName),
-		checkPoolSize: new(int64),
+		index:         make(map[string]*Proxy),
 		goodProxyList: NewGoodProxyList(),
+		pools:         make(map[string]*GoodProxyList),
+		metrics:       metrics,
+		sessions:      newSessionTable(),
+		scheduler:     newScheduler(realClock{}, proxyCheckPool),
+		inFileName:    proxyFileName,
+		saveFileName:  AutoSaveFilename,
+		sources:       make(map[string][]*Proxy),
+		saved:         make(map[string]*Proxy),
+		checker:       checker,
 		grs:           grs,
 	}
+	cached, err := LoadCache(cache.saveFileName)
+	if err != nil {
+		log.Errorf("Can't load proxies cache, start without it: %v", err)
+	}
+	for _, proxy := range cached {
+		cache.saved[proxy.Addr] = proxy
+	}
+	cache.sources[proxyFileName] = entries
+	cache.proxies = cache.restoreProxies(cache.wantedProxies())
+	loadTraffic(cache)
+	cache.goodProxyList.selector = selector
 	heap.Init(&cache.proxies)
 	for i := range cache.proxies {
+		cache.index[cache.proxies[i].Addr] = cache.proxies[i]
+		cache.metrics.setLatency(
+			cache.proxies[i].Addr,
+			cache.proxies[i].Latency.selectionLatency())
 		if cache.proxies[i].failCounter == 0 {
-			cache.goodProxyList.append(cache.proxies[i].Addr)
+			cache.markGood(cache.proxies[i])
 		}
 	}
 	log.Debugf(
 		"%d proxies in good state",
 		len(cache.goodProxyList.proxies))
-	go worker(cache)
-	return cache
+	go cache.schedule()
+	if watchInterval > 0 {
+		go cache.watchInFile(watchInterval)
+	}
+	for _, source := range sources {
+		go cache.watchSource(source)
+	}
+	return cache, nil
 }
 
-func (cc *CacheContext) NextProxy() (string, error) {
-	return cc.goodProxyList.next()
+func (cc *CacheContext) NextProxy() (Proxy, error) {
+	addr, err := cc.goodProxyList.next()
+	if err != nil {
+		return Proxy{}, err
+	}
+	proxy, ok := cc.LookupProxy(addr)
+	if !ok {
+		return Proxy{}, fmt.Errorf("unknown proxy %v", addr)
+	}
+	return proxy, nil
 }
 
-func (cc *CacheContext) Stop() {
-	panic("not implemented error")
+func (cc *CacheContext) LookupProxy(addr string) (Proxy, bool) {
+	cc.lock.RLock()
+	defer cc.lock.RUnlock()
+	proxy, ok := cc.index[addr]
+	if !ok {
+		return Proxy{}, false
+	}
+	return *proxy, true
 }
 
-func worker(pc *CacheContext) {
-	var lastSaved time.Time
-
-	for {
-		lastSaved = saveProxyList(lastSaved, pc)
-		pc.lock.RLock()
-		l := pc.proxies.Len()
-		pc.lock.RUnlock()
-		if l == 0 {
-			continue
-		}
-
-		pc.lock.Lock()
-		proxy := heap.Pop(&pc.proxies).(Proxy)
-		pc.lock.Unlock()
-
-		// If nearest proxy checking in some time, wait for this time
-		waitFor := recheckIn(&proxy)
-		if waitFor > 0 {
-			pc.lock.Lock()
-			heap.Push(&pc.proxies, proxy)
-			pc.lock.Unlock()
-
-			timeToSleep := autoSaveTimeout
-			log.Debugf(
-				"There is %v to check. Sleep for %v now.",
-				waitFor, timeToSleep)
-			time.Sleep(timeToSleep)
+func (cc *CacheContext) Proxies() []Proxy {
+	cc.lock.RLock()
+	var proxies []Proxy = make([]Proxy, 0, len(cc.index))
+	for _, proxy := range cc.index {
+		proxies = append(proxies, *proxy)
+	}
+	cc.lock.RUnlock()
+	sort.Slice(proxies, func(i, j int) bool {
+		return proxies[i].Addr < proxies[j].Addr
+	})
+	return proxies
+}
 
-			continue
-		}
+func (cc *CacheContext) IsGood(addr string) bool {
+	return cc.goodProxyList.contains(addr)
+}
 
-		// If worker pool is full, wait for some time
-		var checkPoolSize int64 = atomic.LoadInt64(pc.checkPoolSize)
-		for checkPoolSize >= proxyCheckPool {
-			log.Debug("Checking pool is full. Wait for one second.")
-			time.Sleep(time.Second)
-			checkPoolSize = atomic.LoadInt64(pc.checkPoolSize)
-		}
+func (cc *CacheContext) Acquire(addr string) {
+	cc.metrics.acquire(addr)
+}
 
-		// Start checking gorotine
-		go pc.checkProxy(proxy)
-	}
+func (cc *CacheContext) Release(addr string) {
+	cc.metrics.release(addr)
 }
 
-func saveProxyList(lastSaved time.Time, pc *CacheContext) time.Time {
-	if time.Now().Add(-autoSaveTimeout).Before(lastSaved) {
-		return lastSaved
+func saveProxyList(pc *CacheContext) {
+	if pc.saveFileName == "" {
+		return
 	}
 
 	pc.lock.RLock()
@@ -123,153 +205,166 @@ func saveProxyList(lastSaved time.Time, pc *CacheContext) time.Time {
 		pc.saveLock.Unlock()
 	}()
 
-	var backup string = fmt.Sprintf("%s.old", autoSaveFilename)
-	//	var isBackedUp bool
-	var err error
-	if _, err = os.Stat(autoSaveFilename); err == nil {
-		//		isBackedUp = true
-		os.Rename(autoSaveFilename, backup)
+	// Proxies being checked are not in heap, so all known ones are taken
+	// from index
+	var proxies ProxyHeap = make(ProxyHeap, 0, len(pc.index))
+	for _, proxy := range pc.index {
+		proxies = append(proxies, proxy)
 	}
-
-	var f *os.File
-	f, err = os.Create(autoSaveFilename)
+	err := writeFileAtomic(pc.saveFileName, func(w io.Writer) error {
+		return gob.NewEncoder(w).Encode(proxies)
+	})
 	if err != nil {
-		log.Errorf("Can't create file to dump proxies: ", err)
+		log.Errorf("Can't dump proxies cache: %v", err)
+		return
 	}
-	defer f.Close()
+	err = writeFileAtomic(
+		trafficFileName(pc.saveFileName), pc.grs.SaveTraffic)
+	if err != nil {
+		log.Errorf("Can't dump traffic stats: %v", err)
+		return
+	}
+	log.Debug("Proxies cache dump")
+}
 
-	encoder := gob.NewEncoder(f)
-	err = encoder.Encode(pc.proxies)
+// Write file with encode. Data is written to temporary file first, so
+// interrupted save does not leave half-written file. Previous file is kept
+// with .old suffix.
+func writeFileAtomic(name string, encode func(io.Writer) error) error {
+	var tmp string = fmt.Sprintf("%s.tmp", name)
+	f, err := os.Create(tmp)
 	if err != nil {
-		log.Errorf("Can't dump proxies cache: %v", err)
-	} else {
-		log.Debug("Proxies cache dump")
+		return err
+	}
+	err = encode(f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
 	}
 
-	return time.Now()
+	var backup string = fmt.Sprintf("%s.old", name)
+	if _, err = os.Stat(name); err == nil {
+		os.Rename(name, backup)
+	}
+	return os.Rename(tmp, name)
+}
+
+// Traffic stats are saved next to proxies cache
+func trafficFileName(saveFileName string) string {
+	return saveFileName + ".traffic"
+}
+
+// Add traffic stats saved by previous run to current ones
+func loadTraffic(pc *CacheContext) {
+	if pc.saveFileName == "" {
+		return
+	}
+	f, err := os.Open(trafficFileName(pc.saveFileName))
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Errorf("Can't load traffic stats: %v", err)
+		return
+	}
+	defer f.Close()
+	if err = pc.grs.LoadTraffic(f); err != nil {
+		log.Errorf("Can't load traffic stats: %v", err)
+	}
 }
 
-func (pc *CacheContext) checkProxy(proxy Proxy) {
+func (pc *CacheContext) checkProxy(proxy *Proxy) {
 	pc.grs.IncCheckProxy()
 	defer pc.grs.DecCheckProxy()
 
-	atomic.AddInt64(pc.checkPoolSize, 1)
-	defer func() {
-		atomic.AddInt64(pc.checkPoolSize, -1)
-
-		pc.lock.Lock()
-		heap.Push(&pc.proxies, proxy)
-		pc.lock.Unlock()
-	}()
+	defer pc.pushProxy(proxy)
 
 	pc.lock.RLock()
-	var proxyAddr string = proxy.Addr
+	var target Proxy = *proxy
 	pc.lock.RUnlock()
 
 	// long operation, put locking after it
-	var checkResult bool = checkWithProxy(proxyAddr)
+	var result CheckResult = pc.checker.Check(&target)
+	if result.OK {
+		checksTotal.Inc(checkResultOK)
+	} else {
+		checksTotal.Inc(result.ErrorClass)
+	}
 
 	pc.lock.Lock()
-	if checkResult {
+	if proxy.removed {
+		pc.lock.Unlock()
+		return
+	}
+	if result.OK {
 		log.Debugf("Proxy %v check OK", proxy.Addr)
+		pc.addTiming(proxy, result.Timing)
+		pc.setAnonymity(proxy, result.Anonymity)
 		if proxy.failCounter != 0 {
-			pc.goodProxyList.append(proxy.Addr)
+			pc.markGood(proxy)
 			proxy.failCounter = 0
 		}
 	} else {
-		log.Debugf("Proxy %v check failed", proxy.Addr)
+		log.Debugf(
+			"Proxy %v check failed (%v): %v",
+			proxy.Addr, result.ErrorClass, result.Err)
 		if proxy.failCounter == 0 {
-			pc.goodProxyList.remove(proxy.Addr)
+			pc.markBad(proxy)
 		}
 		proxy.failCounter++
 	}
-	proxy.lastCheck = time.Now().UTC()
+	proxy.lastCheck = pc.scheduler.clock.Now().UTC()
+	proxy.recheckSoon = false
 	pc.lock.Unlock()
 }
 
-func checkWithProxy(addr string) (result bool) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			Proxy: func(req *http.Request) (*url.URL, error) {
-				return url.Parse(fmt.Sprintf("http://%s", addr))
-			},
-		},
-		Timeout: time.Duration(60 * time.Second),
-	}
-	var req *http.Request
-	var resp *http.Response
-	var err error
-
-	req, err = http.NewRequest("GET", "http://lomaka.org.ua/t.txt", nil)
-	if err != nil {
-		log.Errorf("Can't create request: %v", err)
-		return false
+// Read proxies from input file in -in-format. Empty file name means no
+// file, "-" means stdin.
+func readProxiesFromFile(proxyFileName string) ([]*Proxy, error) {
+	if proxyFileName == "" {
+		return nil, nil
 	}
-
-	req.Header.Add("Cache-Control", "no-cache")
-	req.Header.Add("Proxy-Connection", "Keep-Alive")
-	resp, err = client.Do(req)
-	if err != nil {
-		log.Debugf("Proxy request failed %v: %v", addr, err)
-		return false
-	}
-
-	defer resp.Body.Close()
-
-	out, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		log.Debugf("Can't read from proxy %v: %v", addr, err)
-		return false
+	if proxyFileName == "-" {
+		return parseProxies(os.Stdin, inFormat)
 	}
-	return string(out) == "6b5f2815-5c7a-4970-99f1-8eb290564ddc\n"
-}
-
-// Read proxies from input file. One address:port per line.
-func readProxiesFromFile(proxyFileName string) []Proxy {
 	var file *os.File
 	var err error
 	file, err = os.Open(proxyFileName)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer file.Close()
+	return parseProxies(file, inFormat)
+}
 
-	proxyList := LoadCache()
-
-	var reader *bufio.Scanner = bufio.NewScanner(file)
-	var result []Proxy = make([]Proxy, 0)
+// Restore state of proxies saved by previous run. Proxies not found in
+// save file are bad. Saved state is used once, proxy removed and added
+// again starts as new. Caller must hold cc.lock for writing if cache is
+// running.
+func (cc *CacheContext) restoreProxies(proxies []*Proxy) []*Proxy {
+	var result []*Proxy = make([]*Proxy, 0, len(proxies))
 
 	newProxies := 0
 	cachedProxies := 0
 
-	for reader.Scan() {
-
-		addr := reader.Text()
-
-		i := -1
-		if proxyList != nil {
-			i = sort.Search(
-				len(proxyList),
-				func(i int) bool { return proxyList[i].Addr >= addr })
-			if i == len(proxyList) || proxyList[i].Addr != addr {
-				i = -1
-			}
-		}
-
-		if i == -1 {
-			result = append(
-				result,
-				Proxy{
-					Addr:        reader.Text(),
-					failCounter: 1, // by default proxy is BAD
-				},
-			)
+	for _, proxy := range proxies {
+		saved, ok := cc.saved[proxy.Addr]
+		if !ok {
+			proxy.failCounter = 1 // by default proxy is BAD
+			result = append(result, proxy)
 			newProxies++
-		} else {
-			result = append(result, proxyList[i])
-			cachedProxies++
+			continue
 		}
-
+		delete(cc.saved, proxy.Addr)
+		// scheme, credentials and tags from input file win over saved ones
+		saved.Scheme = proxy.Scheme
+		saved.username = proxy.username
+		saved.password = proxy.password
+		saved.Tags = proxy.Tags
+		result = append(result, saved)
+		cachedProxies++
 	}
 
 	log.Debugf(
@@ -279,32 +374,26 @@ func readProxiesFromFile(proxyFileName string) []Proxy {
 	return result
 }
 
-// Return sorted []Proxy. Use to quck search.
-func LoadCache() ProxyList {
-	_, err := os.Stat(autoSaveFilename)
+// Read proxies from save file sorted by address. Missing file means no
+// saved proxies.
+func LoadCache(fileName string) (ProxyList, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	f, err := os.Open(fileName)
 	if os.IsNotExist(err) {
-		return nil
+		return nil, nil
 	} else if err != nil {
-		// TODO implement error handling
-		panic(err)
-	}
-
-	f, err := os.Open(autoSaveFilename)
-	if err != nil {
-		// TODO implement error handling
-		panic(err)
+		return nil, err
 	}
+	defer f.Close()
 
 	proxyHeap := make(ProxyHeap, 0)
-
-	decoder := gob.NewDecoder(f)
-	err = decoder.Decode(&proxyHeap)
-	if err != nil {
-		// TODO implement error handling
-		panic(err)
+	if err = gob.NewDecoder(f).Decode(&proxyHeap); err != nil {
+		return nil, fmt.Errorf("can't decode %v: %v", fileName, err)
 	}
 
 	proxyList := ProxyList(proxyHeap)
 	sort.Sort(proxyList)
-	return proxyList
+	return proxyList, nil
 }
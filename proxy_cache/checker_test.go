@@ -2,16 +2,135 @@ package proxy_cache
 
 import (
 	"testing"
+	"encoding/gob"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
 	"time"
 )
 
+// Forward HTTP proxy for tests
+func newTestProxy() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			out, err := http.NewRequest(r.Method, r.URL.String(), nil)
+			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			resp, err := http.DefaultTransport.RoundTrip(out)
+			if err != nil {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			defer resp.Body.Close()
+			w.WriteHeader(resp.StatusCode)
+			io.Copy(w, resp.Body)
+		}))
+}
+
 func TestCheckWithProxy(t *testing.T) {
-	badProxy := "120.195.201.189:80"
-	if !checkWithProxy(badProxy) {
-		t.Fail()
+	target := httptest.NewServer(CheckHandler())
+	defer target.Close()
+	proxyServer := newTestProxy()
+	defer proxyServer.Close()
+	proxy := &Proxy{
+		Addr: proxyServer.Listener.Addr().String(), Scheme: SchemeHTTP}
+
+	cases := []struct {
+		status int
+		body   string
+		match  string
+		ok     bool
+		class  string // error class of failed check
+	}{
+		{http.StatusOK, checkBody, MatchExact, true, ""},
+		{0, checkBody[:8], MatchSubstring, true, ""},
+		{http.StatusOK, "^[0-9a-f-]+\n$", MatchRegexp, true, ""},
+		{http.StatusOK, checkBody[:8], MatchExact, false, ErrorClassBody},
+		{http.StatusOK, "other", MatchSubstring, false, ErrorClassBody},
+		{http.StatusNoContent, checkBody, MatchExact, false, ErrorClassStatus},
+	}
+	for _, c := range cases {
+		ct, err := NewCheckTarget(
+			target.URL+"/t.txt", c.status, c.body, c.match, 5*time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result := (&HTTPChecker{ct}).Check(proxy)
+		if result.OK != c.ok || result.ErrorClass != c.class {
+			t.Fatalf("%v %q %v: expected %v %v, got %v %v",
+				c.status, c.body, c.match, c.ok, c.class,
+				result.OK, result.ErrorClass)
+		}
+	}
+
+	// dead proxy
+	ct, _ := NewCheckTarget(
+		target.URL, http.StatusOK, checkBody, MatchExact, 5*time.Second)
+	proxyServer.Close()
+	result := (&HTTPChecker{ct}).Check(proxy)
+	if result.OK || result.ErrorClass != ErrorClassDial {
+		t.Fatalf("dead proxy: %v %v", result.ErrorClass, result.Err)
+	}
+
+	if _, err := NewCheckTarget(
+		target.URL, 0, "(", MatchRegexp, time.Second); err == nil {
+		t.Fatal("expected error for bad regexp")
+	}
+}
+
+func TestSaveProxyList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dynproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cc := newTestCache(
+		&Proxy{Addr: "one"}, &Proxy{Addr: "two"}, &Proxy{Addr: "three"})
+	cc.saveFileName = filepath.Join(dir, "save")
+	saveProxyList(cc)
+	saveProxyList(cc)
+
+	if _, err = os.Stat(cc.saveFileName + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left: %v", err)
+	}
+	if _, err = os.Stat(cc.saveFileName + ".old"); err != nil {
+		t.Fatalf("no backup: %v", err)
+	}
+	f, err := os.Open(cc.saveFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var proxies ProxyHeap
+	if err = gob.NewDecoder(f).Decode(&proxies); err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 3 {
+		t.Fatalf("%d proxies saved", len(proxies))
+	}
+
+	loaded, err := LoadCache(cc.saveFileName)
+	if err != nil || len(loaded) != 3 || loaded[0].Addr != "one" {
+		t.Fatalf("unexpected loaded proxies %v: %v", loaded, err)
+	}
+}
+
+func TestLoadCacheErrors(t *testing.T) {
+	if proxies, err := LoadCache("no-such-file"); proxies != nil || err != nil {
+		t.Fatalf("missing file: %v, %v", proxies, err)
+	}
+	name := writeTempFile(t, "not gob")
+	defer os.Remove(name)
+	if _, err := LoadCache(name); err == nil {
+		t.Fatal("expected error for corrupt file")
 	}
 }
 
@@ -0,0 +1,281 @@
+package proxy_cache
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Connect to proxy itself. Connection to HTTPS proxy is wrapped with TLS.
+func (p *Proxy) Dial(timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", p.Addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.Scheme != SchemeHTTPS {
+		return conn, nil
+	}
+
+	host, _, _ := net.SplitHostPort(p.Addr)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	tlsConn.SetDeadline(time.Now().Add(timeout))
+	if err = tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// Open tunnel to target address through proxy. HTTP proxies are asked with
+// CONNECT method, SOCKS proxies with appropriate handshake.
+func (p *Proxy) DialTunnel(
+	target string, timeout time.Duration,
+) (net.Conn, error) {
+	conn, err := p.Dial(timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(timeout))
+	switch p.Scheme {
+	case SchemeHTTP, SchemeHTTPS:
+		conn, err = httpConnect(conn, target, p.ProxyAuthorization())
+	case SchemeSOCKS4, SchemeSOCKS4A:
+		err = socks4Connect(
+			conn, target, p.username, p.Scheme == SchemeSOCKS4A)
+	case SchemeSOCKS5:
+		err = socks5Connect(conn, target, p.username, p.password)
+	default:
+		err = fmt.Errorf("unsupported proxy scheme %v", p.Scheme)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// Connection with data already buffered by reader
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func httpConnect(
+	conn net.Conn, target string, proxyAuth string,
+) (net.Conn, error) {
+	req := &http.Request{
+		Method:     "CONNECT",
+		URL:        &url.URL{Host: target},
+		Host:       target,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+	}
+	if proxyAuth != "" {
+		req.Header.Set("Proxy-Authorization", proxyAuth)
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+
+	var reader *bufio.Reader = bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return conn, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return conn, fmt.Errorf("proxy refused tunnel: %v", resp.Status)
+	}
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+func splitTarget(target string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return "", 0, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid port in %v", target)
+	}
+	return host, uint16(port), nil
+}
+
+var errSocks4Rejected = errors.New("SOCKS4 request rejected")
+
+// SOCKS4 needs IPv4 address of target, so host name is resolved locally.
+// SOCKS4A passes host name to proxy. Username is sent as user id.
+func socks4Connect(
+	conn net.Conn, target string, userId string, remoteResolve bool,
+) error {
+	host, port, err := splitTarget(target)
+	if err != nil {
+		return err
+	}
+
+	var ip net.IP = net.ParseIP(host).To4()
+	var hostname string
+	if ip == nil {
+		if remoteResolve {
+			ip = net.IPv4(0, 0, 0, 1).To4()
+			hostname = host
+		} else {
+			addr, err := net.ResolveIPAddr("ip4", host)
+			if err != nil {
+				return err
+			}
+			ip = addr.IP.To4()
+		}
+	}
+
+	req := []byte{4, 1, 0, 0}
+	binary.BigEndian.PutUint16(req[2:], port)
+	req = append(req, ip...)
+	req = append(req, userId...)
+	req = append(req, 0)
+	if hostname != "" {
+		req = append(req, hostname...)
+		req = append(req, 0)
+	}
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	var resp [8]byte
+	if _, err = io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0x5a {
+		return errSocks4Rejected
+	}
+	return nil
+}
+
+// Connect to target with SOCKS5 proxy. If username is not empty, offer
+// username/password authentication too.
+func socks5Connect(
+	conn net.Conn, target string, username, password string,
+) error {
+	host, port, err := splitTarget(target)
+	if err != nil {
+		return err
+	}
+
+	var greeting []byte = []byte{5, 1, 0}
+	if username != "" || password != "" {
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err = conn.Write(greeting); err != nil {
+		return err
+	}
+	var method [2]byte
+	if _, err = io.ReadFull(conn, method[:]); err != nil {
+		return err
+	}
+	if method[0] != 5 {
+		return errors.New("invalid SOCKS5 reply")
+	}
+	switch {
+	case method[1] == 0:
+	case method[1] == 2 && len(greeting) == 4:
+		if err = socks5Auth(conn, username, password); err != nil {
+			return err
+		}
+	default:
+		return errors.New("SOCKS5 proxy requires authentication")
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %v", host)
+		}
+		req = append(req, 3, byte(len(host)))
+		req = append(req, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(req, 1)
+		req = append(req, ip4...)
+	} else {
+		req = append(req, 4)
+		req = append(req, ip...)
+	}
+	req = append(req, 0, 0)
+	binary.BigEndian.PutUint16(req[len(req)-2:], port)
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	if _, err = io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		return fmt.Errorf("SOCKS5 request failed with code %d", header[1])
+	}
+
+	// Skip bound address and port
+	var l int
+	switch header[3] {
+	case 1:
+		l = net.IPv4len
+	case 4:
+		l = net.IPv6len
+	case 3:
+		var b [1]byte
+		if _, err = io.ReadFull(conn, b[:]); err != nil {
+			return err
+		}
+		l = int(b[0])
+	default:
+		return fmt.Errorf("unknown SOCKS5 address type %d", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, l+2))
+	return err
+}
+
+// Username/password authentication, RFC 1929
+func socks5Auth(conn net.Conn, username, password string) error {
+	if len(username) > 255 || len(password) > 255 {
+		return errors.New("SOCKS5 credentials too long")
+	}
+	req := []byte{1, byte(len(username))}
+	req = append(req, username...)
+	req = append(req, byte(len(password)))
+	req = append(req, password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	var resp [2]byte
+	if _, err := io.ReadFull(conn, resp[:]); err != nil {
+		return err
+	}
+	if resp[1] != 0 {
+		return errors.New("SOCKS5 authentication failed")
+	}
+	return nil
+}
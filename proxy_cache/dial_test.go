@@ -0,0 +1,214 @@
+package proxy_cache
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Step of scripted proxy: read expected bytes from client, then write reply
+type step struct {
+	expect []byte
+	reply  []byte
+}
+
+// Run client handshake against proxy following script over pipe. Return
+// error of client.
+func runScript(
+	t *testing.T, steps []step, client func(conn net.Conn) error,
+) error {
+	clientConn, proxyConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer proxyConn.Close()
+		for i, s := range steps {
+			got := make([]byte, len(s.expect))
+			if _, err := io.ReadFull(proxyConn, got); err != nil {
+				t.Errorf("step %d: %v", i, err)
+				return
+			}
+			if !bytes.Equal(got, s.expect) {
+				t.Errorf("step %d: got %v, expected %v", i, got, s.expect)
+				return
+			}
+			if _, err := proxyConn.Write(s.reply); err != nil {
+				t.Errorf("step %d: %v", i, err)
+				return
+			}
+		}
+	}()
+	err := client(clientConn)
+	<-done
+	clientConn.Close()
+	return err
+}
+
+// Port 443 in network byte order
+var port443 []byte = []byte{1, 187}
+
+func TestHTTPConnect(t *testing.T) {
+	for _, reply := range []string{
+		"HTTP/1.1 200 Connection established\r\n\r\nhello",
+		"HTTP/1.1 407 Proxy Authentication Required\r\n\r\n",
+	} {
+		clientConn, proxyConn := net.Pipe()
+		go func() {
+			defer proxyConn.Close()
+			req, err := http.ReadRequest(bufio.NewReader(proxyConn))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if req.Method != "CONNECT" || req.Host != "example.com:443" ||
+				req.Header.Get("Proxy-Authorization") != "Basic dTpw" {
+				t.Errorf("unexpected request %v %v %v",
+					req.Method, req.Host, req.Header)
+			}
+			proxyConn.Write([]byte(reply))
+		}()
+
+		conn, err := httpConnect(clientConn, "example.com:443", "Basic dTpw")
+		if strings.Contains(reply, "407") {
+			if err == nil || !strings.Contains(err.Error(), "407") {
+				t.Fatalf("expected refused tunnel, got %v", err)
+			}
+			clientConn.Close()
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// data sent by proxy right after reply belongs to tunnel
+		data, err := ioutil.ReadAll(conn)
+		if err != nil || string(data) != "hello" {
+			t.Fatalf("unexpected tunnel data %q: %v", data, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestSocks4Connect(t *testing.T) {
+	err := runScript(t, []step{{
+		expect: []byte{4, 1, 0, 80, 1, 2, 3, 4, 'u', 0},
+		reply:  []byte{0, 0x5a, 0, 0, 0, 0, 0, 0},
+	}}, func(conn net.Conn) error {
+		return socks4Connect(conn, "1.2.3.4:80", "u", false)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SOCKS4A passes host name to proxy
+	err = runScript(t, []step{{
+		expect: append(
+			[]byte{4, 1, 1, 187, 0, 0, 0, 1, 0}, "example.com\x00"...),
+		reply: []byte{0, 0x5b, 0, 0, 0, 0, 0, 0},
+	}}, func(conn net.Conn) error {
+		return socks4Connect(conn, "example.com:443", "", true)
+	})
+	if err != errSocks4Rejected {
+		t.Fatalf("expected rejection, got %v", err)
+	}
+}
+
+func TestSocks5Connect(t *testing.T) {
+	var (
+		noAuth    step   = step{[]byte{5, 1, 0}, []byte{5, 0}}
+		okReplyV4 []byte = []byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+		requestV4 []byte = []byte{5, 1, 0, 1, 1, 2, 3, 4, 0, 80}
+		domain    []byte = append(
+			append([]byte{5, 1, 0, 3, 11}, "example.com"...), port443...)
+		ipv6 []byte = append(
+			append([]byte{5, 1, 0, 4}, net.ParseIP("::1")...), port443...)
+	)
+	cases := []struct {
+		name     string
+		target   string
+		username string
+		password string
+		steps    []step
+		err      string // expected error substring, empty if none
+	}{
+		{
+			name:   "no auth ipv4",
+			target: "1.2.3.4:80",
+			steps:  []step{noAuth, {requestV4, okReplyV4}},
+		},
+		{
+			name:   "ipv6 with ipv6 bound address",
+			target: "[::1]:443",
+			steps: []step{noAuth, {
+				ipv6,
+				append([]byte{5, 0, 0, 4}, make([]byte, 18)...)}},
+		},
+		{
+			name:     "password auth and domain",
+			target:   "example.com:443",
+			username: "u",
+			password: "p",
+			steps: []step{
+				{[]byte{5, 2, 0, 2}, []byte{5, 2}},
+				{[]byte{1, 1, 'u', 1, 'p'}, []byte{1, 0}},
+				{domain, []byte{5, 0, 0, 3, 3, 'a', 'b', 'c', 0, 0}},
+			},
+		},
+		{
+			name:     "password rejected",
+			target:   "1.2.3.4:80",
+			username: "u",
+			password: "p",
+			steps: []step{
+				{[]byte{5, 2, 0, 2}, []byte{5, 2}},
+				{[]byte{1, 1, 'u', 1, 'p'}, []byte{1, 1}},
+			},
+			err: "authentication failed",
+		},
+		{
+			name:   "auth required",
+			target: "1.2.3.4:80",
+			steps:  []step{{[]byte{5, 1, 0}, []byte{5, 2}}},
+			err:    "requires authentication",
+		},
+		{
+			name:   "no acceptable method",
+			target: "1.2.3.4:80",
+			steps:  []step{{[]byte{5, 1, 0}, []byte{5, 0xff}}},
+			err:    "requires authentication",
+		},
+		{
+			name:   "bad version",
+			target: "1.2.3.4:80",
+			steps:  []step{{[]byte{5, 1, 0}, []byte{4, 0}}},
+			err:    "invalid SOCKS5 reply",
+		},
+		{
+			name:   "connection refused",
+			target: "1.2.3.4:80",
+			steps:  []step{noAuth, {requestV4, []byte{5, 5, 0, 1}}},
+			err:    "code 5",
+		},
+		{
+			name:   "unknown bound address type",
+			target: "1.2.3.4:80",
+			steps:  []step{noAuth, {requestV4, []byte{5, 0, 0, 9}}},
+			err:    "unknown SOCKS5 address type 9",
+		},
+	}
+	for _, c := range cases {
+		err := runScript(t, c.steps, func(conn net.Conn) error {
+			return socks5Connect(conn, c.target, c.username, c.password)
+		})
+		if c.err == "" && err != nil {
+			t.Fatalf("%v: %v", c.name, err)
+		}
+		if c.err != "" && (err == nil || !strings.Contains(err.Error(), c.err)) {
+			t.Fatalf("%v: expected error %q, got %v", c.name, c.err, err)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package proxy_cache
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/olomix/dynproxy/log"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// Formats of proxy lists
+const (
+	// Detect format by content
+	FormatAuto = "auto"
+	// Proxy address or URL per line followed by tags, "#" starts comment
+	FormatLines = "lines"
+	// Columns address, scheme, username, password, tags. Columns may be
+	// reordered with header row naming them.
+	FormatCSV = "csv"
+	// Array of objects with keys address, scheme, username, password and
+	// tags
+	FormatJSON = "json"
+)
+
+var inFormat string
+
+func init() {
+	flag.StringVar(
+		&inFormat,
+		"in-format", FormatAuto,
+		fmt.Sprintf(
+			"format of input file: %v, %v, %v or %v",
+			FormatAuto, FormatLines, FormatCSV, FormatJSON))
+}
+
+// Columns of CSV format in default order
+var csvColumns []string = []string{
+	"address", "scheme", "username", "password", "tags"}
+
+// Proxy in JSON format
+type jsonProxy struct {
+	Address  string   `json:"address"`
+	Scheme   string   `json:"scheme"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	Tags     []string `json:"tags"`
+}
+
+func validFormat(format string) bool {
+	switch format {
+	case FormatAuto, FormatLines, FormatCSV, FormatJSON:
+		return true
+	}
+	return false
+}
+
+// Parse proxy list in format. Invalid entries are logged with their line
+// numbers and skipped, repeated proxies are skipped too.
+func parseProxies(r io.Reader, format string) ([]*Proxy, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatAuto {
+		format = detectFormat(data)
+	}
+
+	var list *proxyList = &proxyList{seen: make(map[string]int)}
+	switch format {
+	case FormatLines:
+		list.parseLines(data)
+	case FormatCSV:
+		list.parseCSV(data)
+	case FormatJSON:
+		err = list.parseJSON(data)
+	default:
+		err = fmt.Errorf("unknown format %v", format)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return list.proxies, nil
+}
+
+// Guess format of proxy list: JSON array, CSV if first entry has commas
+// or lines otherwise.
+func detectFormat(data []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return FormatJSON
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.Contains(line, ",") {
+			return FormatCSV
+		}
+		break
+	}
+	return FormatLines
+}
+
+// Parsed proxies without duplicates
+type proxyList struct {
+	proxies []*Proxy
+	seen    map[string]int // line of proxy by address
+}
+
+func (l *proxyList) add(line int, proxy Proxy, err error) {
+	if err != nil {
+		log.Errorf("Skip proxy on line %d: %v", line, err)
+		return
+	}
+	if first, ok := l.seen[proxy.Addr]; ok {
+		log.Errorf(
+			"Skip proxy on line %d: duplicate of line %d", line, first)
+		return
+	}
+	l.seen[proxy.Addr] = line
+	l.proxies = append(l.proxies, &proxy)
+}
+
+func (l *proxyList) parseLines(data []byte) {
+	for i, line := range strings.Split(string(data), "\n") {
+		line = stripComment(line)
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		proxy, err := ParseProxyLine(line)
+		l.add(i+1, proxy, err)
+	}
+}
+
+func stripComment(line string) string {
+	if i := strings.IndexByte(line, '#'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+func (l *proxyList) parseCSV(data []byte) {
+	var reader *csv.Reader = csv.NewReader(bytes.NewReader(data))
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	var columns []string = csvColumns
+	first := true
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				l.add(parseErr.Line, Proxy{}, parseErr.Err)
+				continue
+			}
+			l.add(0, Proxy{}, err)
+			return
+		}
+		line, _ := reader.FieldPos(0)
+		if first {
+			first = false
+			if header := csvHeader(record); header != nil {
+				columns = header
+				continue
+			}
+		}
+
+		var fields map[string]string = make(map[string]string)
+		for i, value := range record {
+			if i < len(columns) {
+				fields[columns[i]] = strings.TrimSpace(value)
+			}
+		}
+		proxy, err := NewProxy(
+			fields["address"], fields["scheme"],
+			fields["username"], fields["password"],
+			strings.Fields(fields["tags"]))
+		l.add(line, proxy, err)
+	}
+}
+
+// Return lowercase column names if record is header, nil otherwise.
+// Header must have address column.
+func csvHeader(record []string) []string {
+	var (
+		columns []string = make([]string, len(record))
+		found   bool
+	)
+	for i, name := range record {
+		columns[i] = strings.ToLower(strings.TrimSpace(name))
+		if columns[i] == "address" {
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return columns
+}
+
+// JSON entries are numbered as lines, starting with 1.
+func (l *proxyList) parseJSON(data []byte) error {
+	var entries []*jsonProxy
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for i, entry := range entries {
+		if entry == nil {
+			l.add(i+1, Proxy{}, errors.New("empty entry"))
+			continue
+		}
+		proxy, err := NewProxy(
+			entry.Address, entry.Scheme,
+			entry.Username, entry.Password, entry.Tags)
+		l.add(i+1, proxy, err)
+	}
+	return nil
+}
+
+// Build proxy from parts. Address may be URL, then scheme must match it if
+// set. Username and password override credentials of URL.
+func NewProxy(
+	address, scheme, username, password string, tags []string,
+) (Proxy, error) {
+	if address == "" {
+		return Proxy{}, errors.New("empty address")
+	}
+	if scheme != "" && !strings.Contains(address, "://") {
+		address = fmt.Sprintf("%v://%v", scheme, address)
+	}
+	p, err := ParseProxy(address)
+	if err != nil {
+		return p, err
+	}
+	if scheme != "" {
+		parsed, err := ParseProxy(fmt.Sprintf("%v://%v", scheme, p.Addr))
+		if err != nil {
+			return Proxy{}, err
+		}
+		if parsed.Scheme != p.Scheme {
+			return Proxy{}, fmt.Errorf(
+				"scheme %v does not match address", scheme)
+		}
+	}
+	if username != "" || password != "" {
+		p.username = username
+		p.password = password
+	}
+	for _, tag := range tags {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			p.Tags = append(p.Tags, tag)
+		}
+	}
+	return p, nil
+}
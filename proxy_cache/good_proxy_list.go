@@ -6,13 +6,13 @@ import (
 )
 
 type GoodProxyList struct {
-	lock    sync.RWMutex
-	proxies []string
-	nextIdx int
+	lock     sync.RWMutex
+	proxies  []string
+	selector Selector
 }
 
 func NewGoodProxyList() GoodProxyList {
-	return GoodProxyList{}
+	return GoodProxyList{selector: new(roundRobinSelector)}
 }
 
 var ProxyListEmpty = errors.New("Proxy list is empty")
@@ -23,13 +23,27 @@ func (gpl *GoodProxyList) next() (string, error) {
 	if len(gpl.proxies) == 0 {
 		return "", ProxyListEmpty
 	}
+	return gpl.selector.Select(gpl.proxies), nil
+}
+
+// Return copy of list
+func (gpl *GoodProxyList) list() []string {
+	gpl.lock.RLock()
+	defer gpl.lock.RUnlock()
+	proxies := make([]string, len(gpl.proxies))
+	copy(proxies, gpl.proxies)
+	return proxies
+}
 
-	if gpl.nextIdx >= len(gpl.proxies) {
-		gpl.nextIdx = 0
+func (gpl *GoodProxyList) contains(proxyAddr string) bool {
+	gpl.lock.RLock()
+	defer gpl.lock.RUnlock()
+	for i := range gpl.proxies {
+		if gpl.proxies[i] == proxyAddr {
+			return true
+		}
 	}
-	var out string = gpl.proxies[gpl.nextIdx]
-	gpl.nextIdx++
-	return out, nil
+	return false
 }
 
 func (gpl *GoodProxyList) append(proxyAddr string) {
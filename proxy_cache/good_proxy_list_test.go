@@ -10,17 +10,17 @@ func TestGoodProxyList(t *testing.T) {
 	gpl.append("one")
 
 	if !reflect.DeepEqual(gpl.proxies, []string {"one"}) {
-		t.Fatal("proxies = %v", gpl.proxies)
+		t.Fatalf("proxies = %v", gpl.proxies)
 	}
 
 	gpl.append("two")
 	if !reflect.DeepEqual(gpl.proxies, []string {"one", "two"}) {
-		t.Fatal("proxies = %v", gpl.proxies)
+		t.Fatalf("proxies = %v", gpl.proxies)
 	}
 
 	gpl.append("three")
 	if !reflect.DeepEqual(gpl.proxies, []string {"one", "two", "three"}) {
-		t.Fatal("proxies = %v", gpl.proxies)
+		t.Fatalf("proxies = %v", gpl.proxies)
 	}
 
 	n, err := gpl.next()
@@ -0,0 +1,60 @@
+package proxy_cache
+
+import (
+	"flag"
+	"github.com/olomix/dynproxy/log"
+)
+
+// Passive health tracking. Failures of live requests are counted per
+// proxy. When proxy fails liveFailThreshold times in a row, it is removed
+// from good list and rechecked as soon as possible.
+
+var liveFailThreshold uint
+
+func init() {
+	flag.UintVar(
+		&liveFailThreshold,
+		"live-fail-threshold", 3,
+		"mark proxy bad after this number of failed requests in a row, "+
+			"0 to disable")
+}
+
+// Record failed live request through proxy
+func (cc *CacheContext) ReportFailure(addr string) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+
+	proxy, ok := cc.index[addr]
+	if !ok {
+		return
+	}
+	proxyRequestsTotal.Inc(proxy.Name())
+	proxyFailuresTotal.Inc(proxy.Name())
+	if liveFailThreshold == 0 {
+		return
+	}
+	proxy.liveFailures++
+	if proxy.liveFailures < liveFailThreshold || proxy.failCounter != 0 {
+		return
+	}
+
+	log.Printf(
+		"Proxy %v failed %d requests in a row, mark it bad",
+		proxy.Name(), proxy.liveFailures)
+	cc.markBad(proxy)
+	proxy.failCounter = 1
+	proxy.liveFailures = 0
+	cc.checkSoon(proxy)
+}
+
+// Record successful live request through proxy and its timing
+func (cc *CacheContext) ReportSuccess(addr string, timing Timing) {
+	cc.lock.Lock()
+	if proxy, ok := cc.index[addr]; ok {
+		proxy.liveFailures = 0
+		cc.addTiming(proxy, timing)
+		proxyRequestsTotal.Inc(proxy.Name())
+	}
+	cc.lock.Unlock()
+	observeTiming(timing)
+}
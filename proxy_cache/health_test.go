@@ -0,0 +1,65 @@
+package proxy_cache
+
+import (
+	"container/heap"
+	"github.com/olomix/dynproxy/stats"
+	"testing"
+	"time"
+)
+
+func newTestCache(proxies ...*Proxy) *CacheContext {
+	cc := &CacheContext{
+		proxies:       ProxyHeap(proxies),
+		index:         make(map[string]*Proxy),
+		goodProxyList: NewGoodProxyList(),
+		pools:         make(map[string]*GoodProxyList),
+		metrics:       newProxyMetrics(),
+		sessions:      newSessionTable(),
+		scheduler:     newScheduler(realClock{}, proxyCheckPool),
+		sources:       make(map[string][]*Proxy),
+		saved:         make(map[string]*Proxy),
+		grs:           stats.New(),
+	}
+	heap.Init(&cc.proxies)
+	for _, p := range proxies {
+		cc.index[p.Addr] = p
+		if p.failCounter == 0 {
+			cc.markGood(p)
+		}
+	}
+	return cc
+}
+
+func TestReportFailure(t *testing.T) {
+	now := time.Now().UTC()
+	one := &Proxy{Addr: "one", Scheme: SchemeHTTP, lastCheck: now}
+	two := &Proxy{Addr: "two", Scheme: SchemeHTTP, lastCheck: now}
+	cc := newTestCache(one, two)
+
+	for i := uint(1); i < liveFailThreshold; i++ {
+		cc.ReportFailure("one")
+	}
+	cc.ReportSuccess("one", Timing{})
+	for i := uint(1); i < liveFailThreshold; i++ {
+		cc.ReportFailure("one")
+	}
+	if len(cc.goodProxyList.proxies) != 2 || one.failCounter != 0 {
+		t.Fatalf("proxy marked bad too early: %v", one)
+	}
+
+	cc.ReportFailure("one")
+	if len(cc.goodProxyList.proxies) != 1 ||
+		cc.goodProxyList.proxies[0] != "two" {
+		t.Fatalf("good proxies = %v", cc.goodProxyList.proxies)
+	}
+	if one.failCounter != 1 {
+		t.Fatalf("failCounter = %v", one.failCounter)
+	}
+	if cc.proxies[0] != one || recheckIn(one) != 0 {
+		t.Fatal("proxy is not scheduled for recheck")
+	}
+
+	// unknown proxies are ignored
+	cc.ReportFailure("three")
+	cc.ReportSuccess("three", Timing{})
+}
@@ -5,16 +5,16 @@ import (
 	"time"
 )
 
-type ProxyHeap []Proxy
+type ProxyHeap []*Proxy
 
 func (h ProxyHeap) Len() int           { return len(h) }
-func (h ProxyHeap) Less(i, j int) bool { return isLess(&h[i], &h[j]) }
+func (h ProxyHeap) Less(i, j int) bool { return isLess(h[i], h[j]) }
 func (h ProxyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
 
 func (h *ProxyHeap) Push(x interface{}) {
 	// Push and Pop use pointer receivers because they modify the slice's
 	// length, not just its contents.
-	*h = append(*h, x.(Proxy))
+	*h = append(*h, x.(*Proxy))
 }
 
 func (h *ProxyHeap) Pop() interface{} {
@@ -26,35 +26,45 @@ func (h *ProxyHeap) Pop() interface{} {
 }
 
 func isLess(left, right *Proxy) bool {
-	leftCheckIn := recheckIn(left)
-	rightCheckIn := recheckIn(right)
-	if leftCheckIn == rightCheckIn {
+	leftCheckAt := nextCheck(left)
+	rightCheckAt := nextCheck(right)
+	if leftCheckAt.Equal(rightCheckAt) {
 		return stringHash(left.Addr) < stringHash(right.Addr)
 	} else {
-		return leftCheckIn < rightCheckIn
+		return leftCheckAt.Before(rightCheckAt)
 	}
 }
 
-// Return duration in which we need to recheck proxy
-func recheckIn(proxy *Proxy) time.Duration {
-	now := time.Now().UTC()
-	checkInMax := proxy.lastCheck.Add(proxyCheckTimeoutMax)
+// Return time when proxy should be checked next. Zero time if it should
+// be checked as soon as possible.
+func nextCheck(proxy *Proxy) time.Time {
+	if proxy.recheckSoon {
+		return time.Time{}
+	}
 
-	// Catch integer overflow
+	checkAtMax := proxy.lastCheck.Add(proxyCheckTimeoutMax)
+
+	// Catch integer overflow. Larger counters give interval over maximum
+	// anyway.
 	failCounter := proxy.failCounter
-	if failCounter > 30 {
-		failCounter = 30
+	if failCounter > 16 {
+		failCounter = 16
 	}
 
-	checkIn := proxy.lastCheck.Add(proxyCheckTimeoutMin * (1 << failCounter))
-	switch {
-	case checkIn.Before(now):
+	checkAt := proxy.lastCheck.Add(proxyCheckTimeoutMin * (1 << failCounter))
+	if checkAt.After(checkAtMax) {
+		return checkAtMax
+	}
+	return checkAt
+}
+
+// Return duration in which we need to recheck proxy
+func recheckIn(proxy *Proxy) time.Duration {
+	checkIn := nextCheck(proxy).Sub(time.Now().UTC())
+	if checkIn < 0 {
 		return time.Duration(0)
-	case checkIn.After(checkInMax):
-		return checkInMax.Sub(now)
-	default:
-		return checkIn.Sub(now)
 	}
+	return checkIn
 }
 
 func stringHash(in string) uint64 {
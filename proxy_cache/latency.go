@@ -0,0 +1,73 @@
+package proxy_cache
+
+import "time"
+
+// How many last timings to keep per proxy
+const latencyHistorySize = 10
+
+// Weight of new timing in moving average
+const latencyEWMAWeight = 0.3
+
+// Timings of one request through proxy. Zero means not measured.
+type Timing struct {
+	// Time to connect to proxy, including tunnel setup
+	Connect time.Duration
+	// Time from start of request to first byte of response
+	FirstByte time.Duration
+	// Time of whole request including body
+	Total time.Duration
+}
+
+// Latency of proxy measured by checks and live requests
+type LatencyStats struct {
+	// Exponentially weighted moving averages
+	Average Timing
+	// Last timings, oldest first
+	History []Timing
+}
+
+func (s *LatencyStats) add(t Timing) {
+	s.Average.Connect = ewma(s.Average.Connect, t.Connect)
+	s.Average.FirstByte = ewma(s.Average.FirstByte, t.FirstByte)
+	s.Average.Total = ewma(s.Average.Total, t.Total)
+
+	if len(s.History) >= latencyHistorySize {
+		copy(s.History, s.History[len(s.History)-latencyHistorySize+1:])
+		s.History = s.History[:latencyHistorySize-1]
+	}
+	s.History = append(s.History, t)
+}
+
+// Latency used to choose proxy: time to first byte if known, otherwise
+// total or connect time.
+func (s *LatencyStats) selectionLatency() time.Duration {
+	switch {
+	case s.Average.FirstByte > 0:
+		return s.Average.FirstByte
+	case s.Average.Total > 0:
+		return s.Average.Total
+	}
+	return s.Average.Connect
+}
+
+// Move average towards new value. Not measured values are skipped.
+func ewma(average, value time.Duration) time.Duration {
+	if value <= 0 {
+		return average
+	}
+	if average <= 0 {
+		return value
+	}
+	return average + time.Duration(
+		latencyEWMAWeight*float64(value-average))
+}
+
+// Record timing of proxy and update latency used by selectors. Caller
+// must hold cc.lock for writing.
+func (cc *CacheContext) addTiming(proxy *Proxy, t Timing) {
+	if t == (Timing{}) {
+		return
+	}
+	proxy.Latency.add(t)
+	cc.metrics.setLatency(proxy.Addr, proxy.Latency.selectionLatency())
+}
@@ -0,0 +1,48 @@
+package proxy_cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLatencyStats(t *testing.T) {
+	var s LatencyStats
+	s.add(Timing{Connect: 100 * time.Millisecond, Total: time.Second})
+	if s.Average.Connect != 100*time.Millisecond ||
+		s.selectionLatency() != time.Second {
+		t.Fatalf("average = %+v", s.Average)
+	}
+
+	// not measured values keep average
+	s.add(Timing{FirstByte: 200 * time.Millisecond})
+	if s.Average.Connect != 100*time.Millisecond ||
+		s.selectionLatency() != 200*time.Millisecond {
+		t.Fatalf("average = %+v", s.Average)
+	}
+
+	s.add(Timing{Connect: 200 * time.Millisecond})
+	if s.Average.Connect != 130*time.Millisecond {
+		t.Fatalf("average = %+v", s.Average)
+	}
+
+	for i := 0; i < 2*latencyHistorySize; i++ {
+		s.add(Timing{Total: time.Duration(i)})
+	}
+	if len(s.History) != latencyHistorySize ||
+		s.History[latencyHistorySize-1].Total !=
+			time.Duration(2*latencyHistorySize-1) ||
+		s.History[0].Total != time.Duration(latencyHistorySize) {
+		t.Fatalf("history = %v", s.History)
+	}
+}
+
+func TestReportSuccessTiming(t *testing.T) {
+	proxy := &Proxy{Addr: "one", Scheme: SchemeHTTP}
+	cc := newTestCache(proxy)
+	cc.ReportSuccess("one", Timing{FirstByte: time.Second})
+	cc.ReportSuccess("one", Timing{})
+	if len(proxy.Latency.History) != 1 ||
+		cc.metrics.Latency("one") != time.Second {
+		t.Fatalf("latency = %+v", proxy.Latency)
+	}
+}
@@ -0,0 +1,90 @@
+package proxy_cache
+
+import "github.com/olomix/dynproxy/log"
+
+// Management of proxies at runtime, used by control API. Proxies added
+// here are listed by their own source, so reloads of input file keep them.
+// They are not kept after restart unless input file lists them.
+
+const apiSourceName = "api"
+
+// Counters of cache
+type CacheStats struct {
+	Proxies int
+	Good    int
+	// Good proxies by tag
+	Pools map[string]int
+}
+
+// Add proxy. Return false if proxy with the same address is known.
+func (cc *CacheContext) AddProxy(proxy Proxy) bool {
+	cc.lock.Lock()
+	if _, ok := cc.index[proxy.Addr]; ok {
+		cc.lock.Unlock()
+		return false
+	}
+	var p *Proxy = &Proxy{
+		Addr:     proxy.Addr,
+		Scheme:   proxy.Scheme,
+		username: proxy.username,
+		password: proxy.password,
+		Tags:     proxy.Tags,
+	}
+	cc.sources[apiSourceName] = append(cc.sources[apiSourceName], p)
+	cc.applySources()
+	cc.lock.Unlock()
+
+	cc.wake()
+	log.Printf("Proxy %v added", proxy.Name())
+	return true
+}
+
+// Remove proxy from cache and from all sources. Return false if proxy is
+// unknown. Proxy comes back if its source lists it on next fetch.
+func (cc *CacheContext) RemoveProxy(addr string) bool {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if _, ok := cc.index[addr]; !ok {
+		return false
+	}
+	for name, proxies := range cc.sources {
+		var kept []*Proxy
+		for _, proxy := range proxies {
+			if proxy.Addr != addr {
+				kept = append(kept, proxy)
+			}
+		}
+		cc.sources[name] = kept
+	}
+	cc.applySources()
+	log.Printf("Proxy %v removed", addr)
+	return true
+}
+
+// Check proxy as soon as possible. Return false if proxy is unknown.
+func (cc *CacheContext) CheckNow(addr string) bool {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	proxy, ok := cc.index[addr]
+	if !ok {
+		return false
+	}
+	cc.checkSoon(proxy)
+	return true
+}
+
+func (cc *CacheContext) Stats() CacheStats {
+	cc.lock.RLock()
+	defer cc.lock.RUnlock()
+	var stats CacheStats = CacheStats{
+		Proxies: len(cc.index),
+		Good:    len(cc.goodProxyList.list()),
+		Pools:   make(map[string]int),
+	}
+	for tag, gpl := range cc.pools {
+		if n := len(gpl.list()); n > 0 {
+			stats.Pools[tag] = n
+		}
+	}
+	return stats
+}
@@ -0,0 +1,42 @@
+package proxy_cache
+
+import "testing"
+
+func TestManageProxies(t *testing.T) {
+	cc := newTestCache()
+	cc.inFileName = "in.txt"
+	cc.sources["in.txt"] = []*Proxy{{Addr: "1.1.1.1:80", Scheme: SchemeHTTP}}
+	cc.applySources()
+
+	proxy, err := NewProxy("2.2.2.2:1080", "socks5", "u", "p", []string{"a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cc.AddProxy(proxy) || cc.AddProxy(proxy) {
+		t.Fatal("proxy should be added once")
+	}
+	added, ok := cc.LookupProxy("2.2.2.2:1080")
+	if !ok || added.username != "u" || added.FailCounter() == 0 {
+		t.Fatalf("unexpected added proxy %v", added)
+	}
+
+	// added proxy survives reload of input file
+	cc.setSource("in.txt", cc.sources["in.txt"])
+	if _, ok = cc.LookupProxy("2.2.2.2:1080"); !ok {
+		t.Fatal("added proxy is dropped on reload")
+	}
+
+	if !cc.CheckNow("2.2.2.2:1080") || cc.CheckNow("3.3.3.3:80") {
+		t.Fatal("only known proxy may be checked")
+	}
+	if cc.proxies[0].Addr != "2.2.2.2:1080" || !cc.proxies[0].recheckSoon {
+		t.Fatal("proxy is not scheduled for check")
+	}
+
+	if !cc.RemoveProxy("1.1.1.1:80") || cc.RemoveProxy("1.1.1.1:80") {
+		t.Fatal("proxy should be removed once")
+	}
+	if stats := cc.Stats(); stats.Proxies != 1 || stats.Good != 0 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
@@ -0,0 +1,38 @@
+package proxy_cache
+
+import "github.com/olomix/dynproxy/metrics"
+
+// Result of successful check in metrics, failed checks are counted by
+// error class
+const checkResultOK = "ok"
+
+var checksTotal *metrics.Counter = metrics.NewCounter(
+	"dynproxy_checks_total",
+	"Proxy checks by result: ok or class of error.",
+	"result")
+
+var proxyRequestsTotal *metrics.Counter = metrics.NewCounter(
+	"dynproxy_proxy_requests_total",
+	"Live requests through proxy.",
+	"proxy")
+
+var proxyFailuresTotal *metrics.Counter = metrics.NewCounter(
+	"dynproxy_proxy_failures_total",
+	"Failed live requests through proxy.",
+	"proxy")
+
+var upstreamLatency *metrics.Histogram = metrics.NewHistogram(
+	"dynproxy_upstream_latency_seconds",
+	"Time of live requests to connect to proxy and to get first byte "+
+		"of reply.",
+	metrics.DurationBuckets, "phase")
+
+// Record timing of live request in latency histogram
+func observeTiming(t Timing) {
+	if t.Connect > 0 {
+		upstreamLatency.Observe(t.Connect.Seconds(), "connect")
+	}
+	if t.FirstByte > 0 {
+		upstreamLatency.Observe(t.FirstByte.Seconds(), "first_byte")
+	}
+}
@@ -0,0 +1,115 @@
+package proxy_cache
+
+import "fmt"
+
+// Pools of proxies. Every tag of proxy, like "vendor=a", makes pool with
+// its own good list, so requests may be routed to proxies with some tag.
+// Anonymity level of proxy is tag too, like "anonymity=elite".
+
+// Add proxy to good list and to good lists of its tags. Caller must hold
+// cc.lock for writing.
+func (cc *CacheContext) markGood(proxy *Proxy) {
+	cc.goodProxyList.append(proxy.Addr)
+	for _, tag := range proxy.allTags() {
+		gpl, ok := cc.pools[tag]
+		if !ok {
+			gpl = cc.newPool()
+			cc.pools[tag] = gpl
+		}
+		gpl.append(proxy.Addr)
+	}
+}
+
+// Remove proxy from good list and from good lists of its tags. Caller
+// must hold cc.lock for writing.
+func (cc *CacheContext) markBad(proxy *Proxy) {
+	cc.goodProxyList.remove(proxy.Addr)
+	for _, tag := range proxy.allTags() {
+		if gpl, ok := cc.pools[tag]; ok {
+			gpl.remove(proxy.Addr)
+		}
+	}
+}
+
+func (cc *CacheContext) newPool() *GoodProxyList {
+	var gpl GoodProxyList = NewGoodProxyList()
+	if selector, err := NewSelector(selectorName, cc.metrics); err == nil {
+		gpl.selector = selector
+	}
+	return &gpl
+}
+
+// Return next good proxy having any of tags of pool. Empty pool means all
+// proxies.
+func (cc *CacheContext) NextProxyInPool(pool []string) (Proxy, error) {
+	if len(pool) == 0 {
+		return cc.NextProxy()
+	}
+
+	var lists []*GoodProxyList
+	cc.lock.RLock()
+	for _, tag := range pool {
+		if gpl, ok := cc.pools[tag]; ok {
+			lists = append(lists, gpl)
+		}
+	}
+	cc.lock.RUnlock()
+
+	var (
+		addr string
+		err  error
+	)
+	switch len(lists) {
+	case 0:
+		return Proxy{}, ProxyListEmpty
+	case 1:
+		addr, err = lists[0].next()
+	default:
+		addr, err = mergePools(lists)
+	}
+	if err != nil {
+		return Proxy{}, err
+	}
+
+	proxy, ok := cc.LookupProxy(addr)
+	if !ok {
+		return Proxy{}, fmt.Errorf("unknown proxy %v", addr)
+	}
+	return proxy, nil
+}
+
+// Choose proxy from union of several pools with selector of first one.
+func mergePools(lists []*GoodProxyList) (string, error) {
+	var (
+		seen    map[string]bool = make(map[string]bool)
+		proxies []string
+	)
+	for _, gpl := range lists {
+		for _, addr := range gpl.list() {
+			if !seen[addr] {
+				seen[addr] = true
+				proxies = append(proxies, addr)
+			}
+		}
+	}
+	if len(proxies) == 0 {
+		return "", ProxyListEmpty
+	}
+	return lists[0].selector.Select(proxies), nil
+}
+
+// Set anonymity level of proxy. Good proxy moves to pool of new level.
+// Caller must hold cc.lock for writing.
+func (cc *CacheContext) setAnonymity(proxy *Proxy, level string) {
+	if level == "" || level == proxy.Anonymity {
+		return
+	}
+	good := proxy.failCounter == 0
+	if good {
+		cc.markBad(proxy)
+	}
+	proxy.Anonymity = level
+	if good {
+		cc.markGood(proxy)
+	}
+}
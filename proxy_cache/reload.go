@@ -0,0 +1,228 @@
+package proxy_cache
+
+import (
+	"container/heap"
+	"errors"
+	"flag"
+	"github.com/olomix/dynproxy/log"
+	"os"
+	"sort"
+	"time"
+)
+
+var watchInterval time.Duration
+
+func init() {
+	flag.DurationVar(
+		&watchInterval,
+		"watch-in", 0,
+		"check input file for changes with this interval and reload it, "+
+			"disabled if 0")
+}
+
+var errReloadStdin = errors.New("can't reload proxies from stdin")
+
+// Read input file again. New proxies are added with state from save file,
+// proxies missing from file and other sources are dropped, scheme,
+// credentials and tags of others are updated.
+func (cc *CacheContext) Reload() error {
+	if cc.inFileName == "-" {
+		return errReloadStdin
+	}
+	proxies, err := readProxiesFromFile(cc.inFileName)
+	if err != nil {
+		return err
+	}
+	cc.setSource(cc.inFileName, proxies)
+	return nil
+}
+
+// Replace proxies listed by source and apply changes to cache.
+func (cc *CacheContext) setSource(name string, proxies []*Proxy) {
+	cc.lock.Lock()
+	cc.sources[name] = proxies
+	added, updated, removed := cc.applySources()
+	var total int = len(cc.index)
+	cc.lock.Unlock()
+
+	if added > 0 {
+		cc.wake()
+	}
+	log.Printf(
+		"Reloaded %v: %d added, %d removed, %d updated, %d total",
+		name, added, removed, updated, total)
+}
+
+// Proxies listed by all sources. Proxy listed several times gets tags of
+// all entries and scheme and credentials of first one, input file goes
+// first. Caller must hold cc.lock.
+func (cc *CacheContext) wantedProxies() []*Proxy {
+	var names []string
+	for name := range cc.sources {
+		if name != cc.inFileName {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	names = append([]string{cc.inFileName}, names...)
+
+	var (
+		wanted  map[string]*Proxy = make(map[string]*Proxy)
+		proxies []*Proxy
+	)
+	for _, name := range names {
+		for _, entry := range cc.sources[name] {
+			if proxy, ok := wanted[entry.Addr]; ok {
+				proxy.Tags = mergeTags(proxy.Tags, entry.Tags)
+				continue
+			}
+			var proxy Proxy = *entry
+			proxy.Tags = mergeTags(nil, entry.Tags)
+			wanted[proxy.Addr] = &proxy
+			proxies = append(proxies, &proxy)
+		}
+	}
+	return proxies
+}
+
+// Make cache match proxies listed by sources. Caller must hold cc.lock for
+// writing.
+func (cc *CacheContext) applySources() (added, updated, removed int) {
+	var (
+		inSources map[string]bool = make(map[string]bool)
+		fresh     []*Proxy
+	)
+	for _, proxy := range cc.wantedProxies() {
+		inSources[proxy.Addr] = true
+		if known, ok := cc.index[proxy.Addr]; ok {
+			if cc.updateProxy(known, proxy) {
+				updated++
+			}
+		} else {
+			fresh = append(fresh, proxy)
+		}
+	}
+
+	if len(fresh) > 0 {
+		for _, proxy := range cc.restoreProxies(fresh) {
+			heap.Push(&cc.proxies, proxy)
+			cc.index[proxy.Addr] = proxy
+			cc.metrics.setLatency(
+				proxy.Addr, proxy.Latency.selectionLatency())
+			if proxy.failCounter == 0 {
+				cc.markGood(proxy)
+			}
+			added++
+		}
+	}
+
+	for addr, proxy := range cc.index {
+		if inSources[addr] {
+			continue
+		}
+		if proxy.failCounter == 0 {
+			cc.markBad(proxy)
+		}
+		// Proxy being checked is not in heap. Checker drops it itself.
+		proxy.removed = true
+		for i := range cc.proxies {
+			if cc.proxies[i] == proxy {
+				heap.Remove(&cc.proxies, i)
+				break
+			}
+		}
+		delete(cc.index, addr)
+		removed++
+	}
+	return added, updated, removed
+}
+
+// Copy scheme, credentials and tags from sources to known proxy.
+// Return true if anything changed. Caller must hold cc.lock for writing.
+func (cc *CacheContext) updateProxy(known, proxy *Proxy) bool {
+	tagsChanged := !equalTags(known.Tags, proxy.Tags)
+	if !tagsChanged && known.Scheme == proxy.Scheme &&
+		known.username == proxy.username &&
+		known.password == proxy.password {
+		return false
+	}
+	known.Scheme = proxy.Scheme
+	known.username = proxy.username
+	known.password = proxy.password
+	if tagsChanged {
+		// Move good proxy to pools of new tags
+		good := known.failCounter == 0
+		if good {
+			cc.markBad(known)
+		}
+		known.Tags = proxy.Tags
+		if good {
+			cc.markGood(known)
+		}
+	}
+	return true
+}
+
+func equalTags(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Append tags missing from list
+func mergeTags(tags, more []string) []string {
+	for _, tag := range more {
+		found := false
+		for _, t := range tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Reload input file when its size or modification time changes.
+func (cc *CacheContext) watchInFile(interval time.Duration) {
+	if cc.inFileName == "" {
+		return
+	}
+	if cc.inFileName == "-" {
+		log.Error(errReloadStdin)
+		return
+	}
+	var ticker *time.Ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, _ := os.Stat(cc.inFileName)
+	for {
+		select {
+		case <-cc.scheduler.stop:
+			return
+		case <-ticker.C:
+		}
+		info, err := os.Stat(cc.inFileName)
+		if err != nil {
+			log.Errorf("Can't watch %v: %v", cc.inFileName, err)
+			continue
+		}
+		if last != nil && info.Size() == last.Size() &&
+			info.ModTime().Equal(last.ModTime()) {
+			continue
+		}
+		last = info
+		if err = cc.Reload(); err != nil {
+			log.Errorf("Can't reload %v: %v", cc.inFileName, err)
+		}
+	}
+}
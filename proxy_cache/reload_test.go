@@ -0,0 +1,120 @@
+package proxy_cache
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "dynproxy-in")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestReload(t *testing.T) {
+	a := &Proxy{
+		Addr: "1.1.1.1:80", Scheme: SchemeHTTP, Tags: []string{"vendor=a"}}
+	b := &Proxy{Addr: "2.2.2.2:80", Scheme: SchemeHTTP, failCounter: 1}
+	c := &Proxy{Addr: "3.3.3.3:80", Scheme: SchemeHTTP}
+	checking := &Proxy{Addr: "4.4.4.4:80", Scheme: SchemeHTTP}
+	cc := newTestCache(a, b, c, checking)
+	// proxy being checked is not in heap
+	for i := range cc.proxies {
+		if cc.proxies[i] == checking {
+			cc.proxies = append(cc.proxies[:i], cc.proxies[i+1:]...)
+			break
+		}
+	}
+	cc.inFileName = writeTempFile(
+		t, "1.1.1.1:80 vendor=b\nsocks5://2.2.2.2:80\n5.5.5.5:80\n")
+	defer os.Remove(cc.inFileName)
+
+	if err := cc.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, addr := range []string{"3.3.3.3:80", "4.4.4.4:80"} {
+		if _, ok := cc.LookupProxy(addr); ok || cc.IsGood(addr) {
+			t.Fatalf("%v is not removed", addr)
+		}
+	}
+	cc.pushProxy(checking)
+	if len(cc.proxies) != 3 {
+		t.Fatalf("%d proxies in heap", len(cc.proxies))
+	}
+
+	added, ok := cc.LookupProxy("5.5.5.5:80")
+	if !ok || added.failCounter == 0 {
+		t.Fatalf("new proxy should be known and bad: %v", added)
+	}
+	if proxy, _ := cc.LookupProxy("2.2.2.2:80"); proxy.Scheme != SchemeSOCKS5 {
+		t.Fatalf("scheme is not updated: %v", proxy.Scheme)
+	}
+
+	// good proxy moved to pool of new tag
+	if _, err := cc.NextProxyInPool([]string{"vendor=a"}); err == nil {
+		t.Fatal("old pool is not empty")
+	}
+	proxy, err := cc.NextProxyInPool([]string{"vendor=b"})
+	if err != nil || proxy.Addr != "1.1.1.1:80" {
+		t.Fatalf("new pool: %v, %v", proxy.Addr, err)
+	}
+	proxy, err = cc.NextProxy()
+	if err != nil || proxy.Addr != "1.1.1.1:80" {
+		t.Fatalf("good list: %v, %v", proxy.Addr, err)
+	}
+}
+
+func TestReloadSaved(t *testing.T) {
+	cc := newTestCache()
+	cc.saved["1.1.1.1:80"] = &Proxy{Addr: "1.1.1.1:80", Anonymity: "elite"}
+	cc.inFileName = "in.txt"
+
+	cc.setSource("in.txt", []*Proxy{{Addr: "1.1.1.1:80", Scheme: SchemeHTTP}})
+	proxy, _ := cc.LookupProxy("1.1.1.1:80")
+	if !cc.IsGood("1.1.1.1:80") || proxy.Anonymity != "elite" ||
+		proxy.Scheme != SchemeHTTP {
+		t.Fatalf("saved state is not restored: %v", proxy)
+	}
+
+	// removed proxy added again starts as new
+	cc.setSource("in.txt", nil)
+	cc.setSource("in.txt", []*Proxy{{Addr: "1.1.1.1:80", Scheme: SchemeHTTP}})
+	if cc.IsGood("1.1.1.1:80") {
+		t.Fatal("saved state is restored twice")
+	}
+}
+
+func TestReloadStdin(t *testing.T) {
+	cc := newTestCache()
+	cc.inFileName = "-"
+	if err := cc.Reload(); err != errReloadStdin {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestReadProxiesFromStdin(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(stdin *os.File) { os.Stdin = stdin }(os.Stdin)
+	os.Stdin = r
+	w.WriteString("1.1.1.1:80\nsocks5://2.2.2.2:1080\n")
+	w.Close()
+
+	proxies, err := readProxiesFromFile("-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(proxies) != 2 || proxies[1].Addr != "2.2.2.2:1080" {
+		t.Fatalf("unexpected proxies %v", proxies)
+	}
+}
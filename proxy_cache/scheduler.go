@@ -0,0 +1,203 @@
+package proxy_cache
+
+import (
+	"container/heap"
+	"context"
+	"github.com/olomix/dynproxy/log"
+	"sync"
+	"time"
+)
+
+// Clock used by scheduler. Tests replace it to control time.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+}
+
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
+
+// State of check scheduler. Scheduler sleeps until next proxy in heap
+// should be checked or until it is woken up, and runs at most checkLimit
+// checks at once.
+type scheduler struct {
+	clock      Clock
+	checkLimit int
+	wakeup     chan struct{}
+	stop       chan struct{}
+	stopOnce   sync.Once
+	done       chan struct{} // closed when no new checks are started
+	checks     sync.WaitGroup
+}
+
+func newScheduler(clock Clock, checkLimit int) *scheduler {
+	return &scheduler{
+		clock:      clock,
+		checkLimit: checkLimit,
+		wakeup:     make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Wake scheduler up to look at heap again, as proxy was added or its
+// check time changed.
+func (cc *CacheContext) wake() {
+	select {
+	case cc.scheduler.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Stop checking proxies. Wait for running checks until ctx is done and
+// save cache. Checks can't be cancelled, so results of checks still
+// running are not saved.
+func (cc *CacheContext) Stop(ctx context.Context) {
+	var s *scheduler = cc.scheduler
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.done
+
+	var checksDone chan struct{} = make(chan struct{})
+	go func() {
+		s.checks.Wait()
+		close(checksDone)
+	}()
+	select {
+	case <-checksDone:
+	case <-ctx.Done():
+		log.Printf("Save proxies without waiting for running checks")
+	}
+	saveProxyList(cc)
+}
+
+func (cc *CacheContext) schedule() {
+	var (
+		s         *scheduler    = cc.scheduler
+		semaphore chan struct{} = make(chan struct{}, s.checkLimit)
+		saveTimer Timer         = s.clock.NewTimer(autoSaveTimeout)
+	)
+	defer func() {
+		saveTimer.Stop()
+		close(s.done)
+	}()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-saveTimer.C():
+			saveProxyList(cc)
+			saveTimer = s.clock.NewTimer(autoSaveTimeout)
+		default:
+		}
+
+		proxy, wait := cc.popDueProxy()
+		if proxy != nil {
+			select {
+			case semaphore <- struct{}{}:
+			case <-s.stop:
+				cc.pushProxy(proxy)
+				return
+			}
+			s.checks.Add(1)
+			go func() {
+				defer s.checks.Done()
+				defer func() { <-semaphore }()
+				cc.checkProxy(proxy)
+			}()
+			continue
+		}
+
+		// Heap is empty or next check is in future. Sleep until it is
+		// time to check or until something changes.
+		var (
+			checkTimer Timer
+			checkC     <-chan time.Time
+		)
+		if wait >= 0 {
+			checkTimer = s.clock.NewTimer(wait)
+			checkC = checkTimer.C()
+			log.Debugf("Next proxy check in %v", wait)
+		}
+		var stopped bool
+		select {
+		case <-checkC:
+		case <-s.wakeup:
+		case <-saveTimer.C():
+			saveProxyList(cc)
+			saveTimer = s.clock.NewTimer(autoSaveTimeout)
+		case <-s.stop:
+			stopped = true
+		}
+		if checkTimer != nil {
+			checkTimer.Stop()
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+// Pop proxy from heap if it is time to check it. Otherwise return time to
+// wait for next check, or negative duration if heap is empty.
+func (cc *CacheContext) popDueProxy() (*Proxy, time.Duration) {
+	cc.lock.Lock()
+	defer cc.lock.Unlock()
+	if len(cc.proxies) == 0 {
+		return nil, -1
+	}
+	wait := nextCheck(cc.proxies[0]).Sub(cc.scheduler.clock.Now())
+	if wait > 0 {
+		return nil, wait
+	}
+	return heap.Pop(&cc.proxies).(*Proxy), 0
+}
+
+// Put proxy back to heap and let scheduler know about it
+func (cc *CacheContext) pushProxy(proxy *Proxy) {
+	cc.lock.Lock()
+	if proxy.removed {
+		cc.lock.Unlock()
+		return
+	}
+	heap.Push(&cc.proxies, proxy)
+	cc.lock.Unlock()
+	cc.wake()
+}
+
+// Move proxy to head of heap to check it as soon as possible. Caller must
+// hold cc.lock for writing.
+func (cc *CacheContext) checkSoon(proxy *Proxy) {
+	proxy.recheckSoon = true
+	// Proxy is not in heap while it is being checked. Checker will put it
+	// back itself.
+	for i := range cc.proxies {
+		if cc.proxies[i] == proxy {
+			heap.Fix(&cc.proxies, i)
+			cc.wake()
+			break
+		}
+	}
+}
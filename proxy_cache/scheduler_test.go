@@ -0,0 +1,257 @@
+package proxy_cache
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Clock moved forward by test only
+type fakeClock struct {
+	lock   sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	at     time.Time
+	c      chan time.Time
+	active bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) NewTimer(d time.Duration) Timer {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t := &fakeTimer{
+		clock: c, at: c.now.Add(d), c: make(chan time.Time, 1), active: true}
+	if d <= 0 {
+		t.active = false
+		t.c <- c.now
+	} else {
+		c.timers = append(c.timers, t)
+	}
+	return t
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.lock.Lock()
+	defer t.clock.lock.Unlock()
+	active := t.active
+	t.active = false
+	return active
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	var timers []*fakeTimer
+	for _, t := range c.timers {
+		if !t.active {
+			continue
+		}
+		if t.at.After(c.now) {
+			timers = append(timers, t)
+			continue
+		}
+		t.active = false
+		t.c <- c.now
+	}
+	c.timers = timers
+}
+
+// Wait until somebody sleeps on timer firing at given time
+func (c *fakeClock) waitTimer(t *testing.T, at time.Time) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.lock.Lock()
+		for _, timer := range c.timers {
+			if timer.active && timer.at.Equal(at) {
+				c.lock.Unlock()
+				return
+			}
+		}
+		c.lock.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("nobody waits for %v", at)
+}
+
+// Checker reporting checked proxies and blocking until released
+type blockingChecker struct {
+	calls   chan string
+	release chan struct{}
+	running int64
+	maxRun  int64
+}
+
+func newBlockingChecker() *blockingChecker {
+	return &blockingChecker{
+		calls: make(chan string, 100), release: make(chan struct{})}
+}
+
+func (c *blockingChecker) Check(proxy *Proxy) CheckResult {
+	running := atomic.AddInt64(&c.running, 1)
+	for {
+		max := atomic.LoadInt64(&c.maxRun)
+		if running <= max ||
+			atomic.CompareAndSwapInt64(&c.maxRun, max, running) {
+			break
+		}
+	}
+	c.calls <- proxy.Addr
+	<-c.release
+	atomic.AddInt64(&c.running, -1)
+	return CheckResult{OK: true}
+}
+
+func expectCheck(t *testing.T, c *blockingChecker, addr string) {
+	select {
+	case a := <-c.calls:
+		if a != addr {
+			t.Fatalf("checked %v instead of %v", a, addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%v was not checked", addr)
+	}
+}
+
+func TestSchedulerRechecks(t *testing.T) {
+	clock := newFakeClock()
+	proxy := &Proxy{Addr: "one", Scheme: SchemeHTTP, failCounter: 1}
+	cc := newTestCache(proxy)
+	cc.scheduler = newScheduler(clock, 10)
+	checker := newBlockingChecker()
+	cc.checker = checker
+	go cc.schedule()
+	defer cc.Stop(context.Background())
+
+	expectCheck(t, checker, "one")
+	checker.release <- struct{}{}
+
+	// good proxy is checked again after minimal timeout
+	clock.waitTimer(t, clock.Now().Add(proxyCheckTimeoutMin))
+	select {
+	case <-checker.calls:
+		t.Fatal("proxy checked too early")
+	default:
+	}
+	clock.Advance(proxyCheckTimeoutMin)
+	expectCheck(t, checker, "one")
+	checker.release <- struct{}{}
+}
+
+func TestSchedulerCheckLimit(t *testing.T) {
+	clock := newFakeClock()
+	var proxies []*Proxy
+	for _, addr := range testProxies(5) {
+		proxies = append(
+			proxies, &Proxy{Addr: addr, Scheme: SchemeHTTP, failCounter: 1})
+	}
+	cc := newTestCache(proxies...)
+	cc.scheduler = newScheduler(clock, 2)
+	checker := newBlockingChecker()
+	cc.checker = checker
+	go cc.schedule()
+
+	for i := 0; i < len(proxies); i++ {
+		select {
+		case <-checker.calls:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("only %d proxies checked", i)
+		}
+		checker.release <- struct{}{}
+	}
+	if checker.maxRun > 2 {
+		t.Fatalf("%d checks at once", checker.maxRun)
+	}
+	cc.Stop(context.Background())
+	if len(cc.proxies) != len(proxies) {
+		t.Fatalf("%d proxies in heap", len(cc.proxies))
+	}
+}
+
+func TestSchedulerWakeup(t *testing.T) {
+	cc := newTestCache()
+	cc.scheduler = newScheduler(newFakeClock(), 10)
+	checker := newBlockingChecker()
+	cc.checker = checker
+	go cc.schedule()
+
+	// scheduler sleeps on empty heap until proxy is added
+	time.Sleep(10 * time.Millisecond)
+	cc.pushProxy(&Proxy{Addr: "new", Scheme: SchemeHTTP, failCounter: 1})
+	expectCheck(t, checker, "new")
+
+	// Stop waits for running check
+	stopped := make(chan struct{})
+	go func() {
+		cc.Stop(context.Background())
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("Stop did not wait for check")
+	case <-time.After(10 * time.Millisecond):
+	}
+	checker.release <- struct{}{}
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop hangs")
+	}
+	cc.Stop(context.Background()) // second Stop only saves again
+
+	// Stop waits for running check no longer than ctx allows, proxy being
+	// checked is saved anyway
+	dir, err := ioutil.TempDir("", "dynproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cc = newTestCache(&Proxy{Addr: "slow", Scheme: SchemeHTTP, failCounter: 1})
+	cc.scheduler = newScheduler(newFakeClock(), 10)
+	cc.checker = checker
+	cc.saveFileName = filepath.Join(dir, "save")
+	go cc.schedule()
+	expectCheck(t, checker, "slow")
+
+	ctx, cancel := context.WithTimeout(
+		context.Background(), 10*time.Millisecond)
+	defer cancel()
+	stopped = make(chan struct{})
+	go func() {
+		cc.Stop(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop ignores deadline")
+	}
+	saved, err := LoadCache(cc.saveFileName)
+	if err != nil || len(saved) != 1 || saved[0].Addr != "slow" {
+		t.Fatalf("unexpected saved proxies %v: %v", saved, err)
+	}
+	checker.release <- struct{}{}
+}
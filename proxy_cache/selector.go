@@ -0,0 +1,229 @@
+package proxy_cache
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Names of proxy selection strategies
+const (
+	SelectorRoundRobin = "round-robin"
+	SelectorRandom     = "random"
+	SelectorLatency    = "latency"
+	SelectorLeastConn  = "least-conn"
+	SelectorTwoChoices = "p2c"
+)
+
+var selectorName string
+
+func init() {
+	flag.StringVar(
+		&selectorName,
+		"selector", SelectorRoundRobin,
+		fmt.Sprintf(
+			"strategy to choose good proxy: %v, %v, %v, %v or %v",
+			SelectorRoundRobin, SelectorRandom, SelectorLatency,
+			SelectorLeastConn, SelectorTwoChoices))
+}
+
+// Selector chooses proxy from list of good proxies. List is never empty.
+// Select may be called concurrently.
+type Selector interface {
+	Select(proxies []string) string
+}
+
+// Load of proxies used by selectors
+type ProxyMetrics interface {
+	// Number of requests being served by proxy now
+	ActiveRequests(addr string) int64
+	// Latency measured for proxy, 0 if unknown
+	Latency(addr string) time.Duration
+}
+
+func NewSelector(name string, metrics ProxyMetrics) (Selector, error) {
+	switch name {
+	case SelectorRoundRobin:
+		return new(roundRobinSelector), nil
+	case SelectorRandom:
+		return randomSelector{}, nil
+	case SelectorLatency:
+		return latencySelector{metrics}, nil
+	case SelectorLeastConn:
+		return &leastConnSelector{metrics: metrics}, nil
+	case SelectorTwoChoices:
+		return twoChoicesSelector{metrics}, nil
+	}
+	return nil, fmt.Errorf("unknown proxy selector %v", name)
+}
+
+type roundRobinSelector struct {
+	next uint64
+}
+
+func (s *roundRobinSelector) Select(proxies []string) string {
+	n := atomic.AddUint64(&s.next, 1) - 1
+	return proxies[n%uint64(len(proxies))]
+}
+
+type randomSelector struct{}
+
+func (randomSelector) Select(proxies []string) string {
+	return proxies[rand.Intn(len(proxies))]
+}
+
+// Choose proxy randomly with probability inversely proportional to its
+// latency. Proxies with unknown latency get average latency of others.
+type latencySelector struct {
+	metrics ProxyMetrics
+}
+
+func (s latencySelector) Select(proxies []string) string {
+	var (
+		latencies []time.Duration = make([]time.Duration, len(proxies))
+		known     int
+		sum       time.Duration
+	)
+	for i := range proxies {
+		latencies[i] = s.metrics.Latency(proxies[i])
+		if latencies[i] > 0 {
+			known++
+			sum += latencies[i]
+		}
+	}
+	if known == 0 {
+		return randomSelector{}.Select(proxies)
+	}
+
+	var (
+		average time.Duration = sum / time.Duration(known)
+		weights []float64     = make([]float64, len(proxies))
+		total   float64
+	)
+	for i := range latencies {
+		if latencies[i] <= 0 {
+			latencies[i] = average
+		}
+		weights[i] = 1 / latencies[i].Seconds()
+		total += weights[i]
+	}
+
+	r := rand.Float64() * total
+	for i := range weights {
+		r -= weights[i]
+		if r < 0 {
+			return proxies[i]
+		}
+	}
+	return proxies[len(proxies)-1]
+}
+
+// Choose proxy with least active requests. Search starts from rotating
+// position, so ties are spread evenly.
+type leastConnSelector struct {
+	metrics ProxyMetrics
+	next    uint64
+}
+
+func (s *leastConnSelector) Select(proxies []string) string {
+	start := int((atomic.AddUint64(&s.next, 1) - 1) % uint64(len(proxies)))
+	var (
+		best       string = proxies[start]
+		bestActive int64  = s.metrics.ActiveRequests(best)
+	)
+	for i := 1; i < len(proxies) && bestActive > 0; i++ {
+		p := proxies[(start+i)%len(proxies)]
+		if active := s.metrics.ActiveRequests(p); active < bestActive {
+			best, bestActive = p, active
+		}
+	}
+	return best
+}
+
+// Power of two choices: take two random proxies and choose one with less
+// active requests, or with lower latency if they are equally loaded.
+type twoChoicesSelector struct {
+	metrics ProxyMetrics
+}
+
+func (s twoChoicesSelector) Select(proxies []string) string {
+	if len(proxies) == 1 {
+		return proxies[0]
+	}
+	i := rand.Intn(len(proxies))
+	j := rand.Intn(len(proxies) - 1)
+	if j >= i {
+		j++
+	}
+	a, b := proxies[i], proxies[j]
+
+	activeA := s.metrics.ActiveRequests(a)
+	activeB := s.metrics.ActiveRequests(b)
+	switch {
+	case activeA < activeB:
+		return a
+	case activeB < activeA:
+		return b
+	}
+	latencyA := s.metrics.Latency(a)
+	latencyB := s.metrics.Latency(b)
+	if latencyB > 0 && (latencyA == 0 || latencyB < latencyA) {
+		return b
+	}
+	return a
+}
+
+// Per proxy load counters. Lock protects only map, counters are atomic.
+type proxyLoad struct {
+	active  int64
+	latency int64 // nanoseconds
+}
+
+type proxyMetrics struct {
+	lock  sync.RWMutex
+	loads map[string]*proxyLoad
+}
+
+func newProxyMetrics() *proxyMetrics {
+	return &proxyMetrics{loads: make(map[string]*proxyLoad)}
+}
+
+func (m *proxyMetrics) get(addr string) *proxyLoad {
+	m.lock.RLock()
+	load, ok := m.loads[addr]
+	m.lock.RUnlock()
+	if ok {
+		return load
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if load, ok = m.loads[addr]; !ok {
+		load = new(proxyLoad)
+		m.loads[addr] = load
+	}
+	return load
+}
+
+func (m *proxyMetrics) ActiveRequests(addr string) int64 {
+	return atomic.LoadInt64(&m.get(addr).active)
+}
+
+func (m *proxyMetrics) Latency(addr string) time.Duration {
+	return time.Duration(atomic.LoadInt64(&m.get(addr).latency))
+}
+
+func (m *proxyMetrics) setLatency(addr string, latency time.Duration) {
+	atomic.StoreInt64(&m.get(addr).latency, int64(latency))
+}
+
+func (m *proxyMetrics) acquire(addr string) {
+	atomic.AddInt64(&m.get(addr).active, 1)
+}
+
+func (m *proxyMetrics) release(addr string) {
+	atomic.AddInt64(&m.get(addr).active, -1)
+}
@@ -0,0 +1,235 @@
+package proxy_cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func testProxies(n int) []string {
+	proxies := make([]string, n)
+	for i := range proxies {
+		proxies[i] = fmt.Sprintf("proxy%d", i)
+	}
+	return proxies
+}
+
+func countSelections(s Selector, proxies []string, n int) map[string]int {
+	counts := make(map[string]int)
+	for i := 0; i < n; i++ {
+		counts[s.Select(proxies)]++
+	}
+	return counts
+}
+
+func TestNewSelector(t *testing.T) {
+	for _, name := range []string{
+		SelectorRoundRobin, SelectorRandom, SelectorLatency,
+		SelectorLeastConn, SelectorTwoChoices,
+	} {
+		if _, err := NewSelector(name, newProxyMetrics()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := NewSelector("unknown", newProxyMetrics()); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRoundRobinSelectorFair(t *testing.T) {
+	proxies := testProxies(5)
+	counts := countSelections(new(roundRobinSelector), proxies, 500)
+	for _, p := range proxies {
+		if counts[p] != 100 {
+			t.Fatalf("counts = %v", counts)
+		}
+	}
+}
+
+func TestRandomSelectorFair(t *testing.T) {
+	proxies := testProxies(4)
+	counts := countSelections(randomSelector{}, proxies, 40000)
+	for _, p := range proxies {
+		if counts[p] < 9000 || counts[p] > 11000 {
+			t.Fatalf("counts = %v", counts)
+		}
+	}
+}
+
+func TestLatencySelector(t *testing.T) {
+	proxies := testProxies(3)
+	m := newProxyMetrics()
+	m.setLatency(proxies[0], 100*time.Millisecond)
+	m.setLatency(proxies[1], 300*time.Millisecond)
+	// proxies[2] has unknown latency and gets average 200ms
+
+	counts := countSelections(latencySelector{m}, proxies, 60000)
+	// weights are 1/0.1, 1/0.3, 1/0.2 so shares are 6/11, 2/11, 3/11
+	expected := []int{60000 * 6 / 11, 60000 * 2 / 11, 60000 * 3 / 11}
+	for i, p := range proxies {
+		if counts[p] < expected[i]*9/10 || counts[p] > expected[i]*11/10 {
+			t.Fatalf("counts = %v, expected %v", counts, expected)
+		}
+	}
+}
+
+func TestLeastConnSelector(t *testing.T) {
+	proxies := testProxies(3)
+	m := newProxyMetrics()
+	s := &leastConnSelector{metrics: m}
+
+	// all idle, spread evenly
+	counts := countSelections(s, proxies, 300)
+	for _, p := range proxies {
+		if counts[p] != 100 {
+			t.Fatalf("counts = %v", counts)
+		}
+	}
+
+	m.acquire(proxies[0])
+	m.acquire(proxies[1])
+	m.acquire(proxies[1])
+	m.acquire(proxies[2])
+	m.acquire(proxies[2])
+	for i := 0; i < 10; i++ {
+		if p := s.Select(proxies); p != proxies[0] {
+			t.Fatalf("selected %v", p)
+		}
+	}
+
+	m.release(proxies[1])
+	m.release(proxies[1])
+	if p := s.Select(proxies); p != proxies[1] {
+		t.Fatalf("selected %v", p)
+	}
+}
+
+func TestTwoChoicesSelector(t *testing.T) {
+	proxies := testProxies(2)
+	m := newProxyMetrics()
+	s := twoChoicesSelector{m}
+
+	m.acquire(proxies[0])
+	for i := 0; i < 10; i++ {
+		if p := s.Select(proxies); p != proxies[1] {
+			t.Fatalf("selected %v", p)
+		}
+	}
+
+	m.release(proxies[0])
+	m.setLatency(proxies[0], time.Millisecond)
+	m.setLatency(proxies[1], time.Second)
+	for i := 0; i < 10; i++ {
+		if p := s.Select(proxies); p != proxies[0] {
+			t.Fatalf("selected %v", p)
+		}
+	}
+
+	if p := s.Select(proxies[:1]); p != proxies[0] {
+		t.Fatalf("selected %v", p)
+	}
+}
+
+// Every selector must be safe for concurrent use together with list
+// modifications. Round robin must stay fair under concurrency.
+func TestGoodProxyListConcurrent(t *testing.T) {
+	const workers = 8
+	const perWorker = 1000
+
+	for _, name := range []string{
+		SelectorRoundRobin, SelectorRandom, SelectorLatency,
+		SelectorLeastConn, SelectorTwoChoices,
+	} {
+		m := newProxyMetrics()
+		s, _ := NewSelector(name, m)
+		gpl := NewGoodProxyList()
+		gpl.selector = s
+		proxies := testProxies(4)
+		for _, p := range proxies {
+			gpl.append(p)
+		}
+
+		var lock sync.Mutex
+		counts := make(map[string]int)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				local := make(map[string]int)
+				for i := 0; i < perWorker; i++ {
+					p, err := gpl.next()
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					m.acquire(p)
+					local[p]++
+					m.release(p)
+				}
+				lock.Lock()
+				for p, c := range local {
+					counts[p] += c
+				}
+				lock.Unlock()
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				gpl.append("extra")
+				gpl.remove("extra")
+			}
+		}()
+		wg.Wait()
+
+		total := 0
+		for _, c := range counts {
+			total += c
+		}
+		if total != workers*perWorker {
+			t.Fatalf("%v: total = %v", name, total)
+		}
+		for _, p := range proxies {
+			if m.ActiveRequests(p) != 0 {
+				t.Fatalf("%v: active requests leaked", name)
+			}
+		}
+	}
+}
+
+func TestRoundRobinConcurrentFair(t *testing.T) {
+	const workers = 8
+	const perWorker = 1000
+
+	gpl := NewGoodProxyList()
+	proxies := testProxies(4)
+	for _, p := range proxies {
+		gpl.append(p)
+	}
+
+	var lock sync.Mutex
+	counts := make(map[string]int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				p, _ := gpl.next()
+				lock.Lock()
+				counts[p]++
+				lock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, p := range proxies {
+		if counts[p] != workers*perWorker/len(proxies) {
+			t.Fatalf("counts = %v", counts)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package proxy_cache
+
+import (
+	"flag"
+	"sync"
+	"time"
+)
+
+// Sticky sessions. Requests of user with the same session ID are served by
+// the same good proxy while session is in use. Sessions of different users
+// are separate even if their IDs are the same. Session expires after
+// sessionTTL of inactivity. If proxy of session leaves good list, session
+// moves to another good proxy.
+
+var sessionTTL time.Duration
+
+func init() {
+	flag.DurationVar(
+		&sessionTTL,
+		"session-ttl", 10*time.Minute,
+		"sticky session expires after this time of inactivity")
+}
+
+type sessionKey struct {
+	user string
+	id   string
+}
+
+type stickySession struct {
+	addr     string
+	lastUsed time.Time
+}
+
+type sessionTable struct {
+	lock      sync.Mutex
+	sessions  map[sessionKey]*stickySession
+	lastSweep time.Time
+}
+
+func newSessionTable() *sessionTable {
+	return &sessionTable{sessions: make(map[sessionKey]*stickySession)}
+}
+
+// Return proxy of session of user. If session is new, expired or its proxy
+// is not good anymore or not in pool, bind session to next good proxy of
+// pool.
+func (cc *CacheContext) SessionProxy(
+	user, session string, pool []string,
+) (Proxy, error) {
+	var key sessionKey = sessionKey{user: user, id: session}
+	st := cc.sessions
+	st.lock.Lock()
+	defer st.lock.Unlock()
+
+	now := time.Now()
+	st.sweep(now)
+
+	s, ok := st.sessions[key]
+	if ok && now.Sub(s.lastUsed) < sessionTTL &&
+		cc.goodProxyList.contains(s.addr) {
+		if proxy, ok := cc.LookupProxy(s.addr); ok && proxy.InPool(pool) {
+			s.lastUsed = now
+			return proxy, nil
+		}
+	}
+
+	proxy, err := cc.NextProxyInPool(pool)
+	if err != nil {
+		return proxy, err
+	}
+	st.sessions[key] = &stickySession{addr: proxy.Addr, lastUsed: now}
+	return proxy, nil
+}
+
+// Drop expired sessions, not more often than once per TTL
+func (st *sessionTable) sweep(now time.Time) {
+	if now.Sub(st.lastSweep) < sessionTTL {
+		return
+	}
+	st.lastSweep = now
+	for key, s := range st.sessions {
+		if now.Sub(s.lastUsed) >= sessionTTL {
+			delete(st.sessions, key)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package proxy_cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionProxy(t *testing.T) {
+	now := time.Now().UTC()
+	cc := newTestCache(
+		&Proxy{Addr: "one", Scheme: SchemeHTTP, lastCheck: now},
+		&Proxy{Addr: "two", Scheme: SchemeHTTP, lastCheck: now},
+	)
+
+	first, err := cc.SessionProxy("", "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		p, err := cc.SessionProxy("", "a", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Addr != first.Addr {
+			t.Fatalf("session moved from %v to %v", first.Addr, p.Addr)
+		}
+	}
+
+	// other session gets next proxy in round robin
+	other, err := cc.SessionProxy("", "b", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Addr == first.Addr {
+		t.Fatalf("both sessions on %v", first.Addr)
+	}
+
+	// proxy left good list, session fails over
+	cc.goodProxyList.remove(first.Addr)
+	p, err := cc.SessionProxy("", "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Addr != other.Addr {
+		t.Fatalf("session did not fail over: %v", p.Addr)
+	}
+}
+
+func TestSessionProxyExpire(t *testing.T) {
+	defer func(ttl time.Duration) { sessionTTL = ttl }(sessionTTL)
+	sessionTTL = 10 * time.Millisecond
+
+	now := time.Now().UTC()
+	cc := newTestCache(
+		&Proxy{Addr: "one", Scheme: SchemeHTTP, lastCheck: now},
+		&Proxy{Addr: "two", Scheme: SchemeHTTP, lastCheck: now},
+	)
+
+	first, _ := cc.SessionProxy("", "a", nil)
+	time.Sleep(2 * sessionTTL)
+	p, err := cc.SessionProxy("", "a", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Addr == first.Addr {
+		t.Fatal("session did not expire")
+	}
+	if len(cc.sessions.sessions) != 1 {
+		t.Fatalf("sessions = %v", cc.sessions.sessions)
+	}
+}
+
+func TestSessionProxyPool(t *testing.T) {
+	now := time.Now().UTC()
+	cc := newTestCache(
+		&Proxy{Addr: "one", Scheme: SchemeHTTP, lastCheck: now},
+		&Proxy{
+			Addr: "two", Scheme: SchemeHTTP, lastCheck: now,
+			Tags: []string{"vendor=a"},
+		},
+	)
+
+	for i := 0; i < 5; i++ {
+		p, err := cc.NextProxyInPool([]string{"vendor=a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Addr != "two" {
+			t.Fatalf("proxy %v is not in pool", p.Addr)
+		}
+	}
+	if _, err := cc.NextProxyInPool([]string{"vendor=b"}); err == nil {
+		t.Fatal("expected error for empty pool")
+	}
+	p, err := cc.NextProxyInPool([]string{"vendor=b", "vendor=a"})
+	if err != nil || p.Addr != "two" {
+		t.Fatalf("proxy %v from union of pools: %v", p.Addr, err)
+	}
+
+	// session moves to pool it is asked for
+	cc.SessionProxy("", "a", nil)
+	cc.SessionProxy("", "a", nil)
+	p, err = cc.SessionProxy("", "a", []string{"vendor=a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Addr != "two" {
+		t.Fatalf("session proxy %v is not in pool", p.Addr)
+	}
+}
+
+func TestSessionProxyUsers(t *testing.T) {
+	now := time.Now().UTC()
+	cc := newTestCache(
+		&Proxy{
+			Addr: "one", Scheme: SchemeHTTP, lastCheck: now,
+			Tags: []string{"vendor=a"},
+		},
+		&Proxy{
+			Addr: "two", Scheme: SchemeHTTP, lastCheck: now,
+			Tags: []string{"vendor=b"},
+		},
+	)
+
+	// users of different pools with the same session ID keep their proxies
+	for i := 0; i < 3; i++ {
+		a, err := cc.SessionProxy("alice", "s", []string{"vendor=a"})
+		if err != nil || a.Addr != "one" {
+			t.Fatalf("alice got %v: %v", a.Addr, err)
+		}
+		b, err := cc.SessionProxy("bob", "s", []string{"vendor=b"})
+		if err != nil || b.Addr != "two" {
+			t.Fatalf("bob got %v: %v", b.Addr, err)
+		}
+	}
+	if len(cc.sessions.sessions) != 2 {
+		t.Fatalf("sessions = %v", cc.sessions.sessions)
+	}
+}
@@ -0,0 +1,161 @@
+package proxy_cache
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/olomix/dynproxy/log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// Proxy lists published by vendors at URLs. Every source is fetched on
+// start and then every interval. Proxies of source get tag
+// "source=<name>". Proxy is dropped when no source lists it anymore.
+
+const defaultSourceInterval = 10 * time.Minute
+const sourceFetchTimeout = 60 * time.Second
+const sourceTagPrefix = "source="
+
+var sourcesFileName string
+
+func init() {
+	flag.StringVar(
+		&sourcesFileName,
+		"sources", "",
+		"JSON file with list of URLs to fetch proxies from, disabled if "+
+			"empty")
+}
+
+// Remote proxy list in any of formats of input file.
+type Source struct {
+	// Name used in tag of proxies, host of URL if empty
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// How often to fetch list, like "10m"
+	Interval string `json:"interval"`
+	// Headers of request, like {"Authorization": "Bearer ..."}
+	Headers map[string]string `json:"headers"`
+	// One of Format constants, detected if empty
+	Format string `json:"format"`
+
+	interval time.Duration
+}
+
+// Read JSON file with array of sources. Empty file name means no sources.
+func ReadSources(fileName string) ([]*Source, error) {
+	if fileName == "" {
+		return nil, nil
+	}
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var sources []*Source
+	if err = json.NewDecoder(file).Decode(&sources); err != nil {
+		return nil, fmt.Errorf("%v: %v", fileName, err)
+	}
+	var names map[string]bool = make(map[string]bool)
+	for _, source := range sources {
+		if err = source.init(); err != nil {
+			return nil, fmt.Errorf("%v: %v", fileName, err)
+		}
+		if names[source.Name] {
+			return nil, fmt.Errorf(
+				"%v: duplicate source %v", fileName, source.Name)
+		}
+		names[source.Name] = true
+	}
+	return sources, nil
+}
+
+// Validate source and fill defaults
+func (s *Source) init() error {
+	if s == nil {
+		return fmt.Errorf("empty source")
+	}
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("source URL %q is not HTTP", s.URL)
+	}
+	if s.Name == "" {
+		s.Name = u.Host
+	}
+	if s.Format == "" {
+		s.Format = FormatAuto
+	}
+	if !validFormat(s.Format) {
+		return fmt.Errorf("unknown format %v of %v", s.Format, s.Name)
+	}
+	s.interval = defaultSourceInterval
+	if s.Interval != "" {
+		if s.interval, err = time.ParseDuration(s.Interval); err != nil {
+			return fmt.Errorf("bad interval of %v: %v", s.Name, err)
+		}
+		if s.interval <= 0 {
+			return fmt.Errorf("bad interval of %v: %v", s.Name, s.Interval)
+		}
+	}
+	return nil
+}
+
+// Download proxy list of source. Every proxy is tagged with source.
+func (s *Source) fetch() ([]*Proxy, error) {
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, value := range s.Headers {
+		req.Header.Set(name, value)
+	}
+	client := &http.Client{Timeout: sourceFetchTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %v", resp.Status)
+	}
+
+	proxies, err := parseProxies(resp.Body, s.Format)
+	if err != nil {
+		return nil, err
+	}
+	for _, proxy := range proxies {
+		proxy.Tags = mergeTags(proxy.Tags, []string{sourceTagPrefix + s.Name})
+	}
+	return proxies, nil
+}
+
+// Fetch source and merge its proxies to cache. On failure proxies of
+// source are kept as they were.
+func (cc *CacheContext) fetchSource(s *Source) {
+	proxies, err := s.fetch()
+	if err != nil {
+		log.Errorf("Can't fetch proxies from %v: %v", s.Name, err)
+		return
+	}
+	cc.setSource(sourceTagPrefix+s.Name, proxies)
+}
+
+// Fetch source now and then every interval until cache is stopped.
+func (cc *CacheContext) watchSource(s *Source) {
+	var ticker *time.Ticker = time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		cc.fetchSource(s)
+		select {
+		case <-cc.scheduler.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package proxy_cache
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Server of proxy list requiring token
+type listServer struct {
+	lock sync.Mutex
+	list string
+	code int
+}
+
+func (s *listServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer token" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.code != 0 {
+		w.WriteHeader(s.code)
+		return
+	}
+	w.Write([]byte(s.list))
+}
+
+func (s *listServer) set(list string, code int) {
+	s.lock.Lock()
+	s.list, s.code = list, code
+	s.lock.Unlock()
+}
+
+func TestFetchSource(t *testing.T) {
+	list := &listServer{
+		list: "1.1.1.1:80\nsocks5://2.2.2.2:1080 country=de\n"}
+	server := httptest.NewServer(list)
+	defer server.Close()
+
+	source := &Source{
+		Name:    "vendor",
+		URL:     server.URL + "/list.txt",
+		Headers: map[string]string{"Authorization": "Bearer token"},
+	}
+	if err := source.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	cc := newTestCache()
+	cc.inFileName = "in.txt"
+	cc.sources["in.txt"] = []*Proxy{{Addr: "1.1.1.1:80", Scheme: SchemeHTTP}}
+	cc.fetchSource(source)
+
+	proxy, ok := cc.LookupProxy("2.2.2.2:1080")
+	if !ok {
+		t.Fatal("proxy of source is not added")
+	}
+	if !proxy.InPool([]string{"source=vendor"}) ||
+		!proxy.InPool([]string{"country=de"}) {
+		t.Fatalf("unexpected tags %v", proxy.Tags)
+	}
+	if proxy, _ = cc.LookupProxy("1.1.1.1:80"); !proxy.InPool(
+		[]string{"source=vendor"}) {
+		t.Fatalf("proxy of file and source has tags %v", proxy.Tags)
+	}
+
+	// failed fetch keeps proxies
+	list.set("", http.StatusInternalServerError)
+	cc.fetchSource(source)
+	if _, ok = cc.LookupProxy("2.2.2.2:1080"); !ok {
+		t.Fatal("proxy is dropped on failed fetch")
+	}
+
+	// proxy of input file stays when source drops it
+	list.set("3.3.3.3:80\n", 0)
+	cc.fetchSource(source)
+	if _, ok = cc.LookupProxy("2.2.2.2:1080"); ok {
+		t.Fatal("proxy dropped by source is kept")
+	}
+	if proxy, ok = cc.LookupProxy("1.1.1.1:80"); !ok ||
+		proxy.InPool([]string{"source=vendor"}) {
+		t.Fatalf("proxy of input file: %v, %v", ok, proxy.Tags)
+	}
+	if len(cc.index) != 2 || len(cc.proxies) != 2 {
+		t.Fatalf("%d proxies, %d in heap", len(cc.index), len(cc.proxies))
+	}
+}
+
+func TestReadSources(t *testing.T) {
+	fileName := writeTempFile(t, `[
+		{"url": "https://vendor.example.com/list", "interval": "1h"},
+		{"name": "b", "url": "http://b.example.com/list",
+		 "headers": {"Authorization": "Bearer x"}}
+	]`)
+	defer os.Remove(fileName)
+	sources, err := ReadSources(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sources) != 2 ||
+		sources[0].Name != "vendor.example.com" ||
+		sources[0].interval != time.Hour ||
+		sources[1].interval != defaultSourceInterval {
+		t.Fatalf("unexpected sources %+v", sources)
+	}
+
+	for _, bad := range []string{
+		`[{"url": "ftp://example.com/list"}]`,
+		`[{"url": "http://example.com/list", "interval": "soon"}]`,
+		`[{"url": "http://a/1"}, {"url": "http://a/2"}]`,
+		`[null]`,
+	} {
+		fileName := writeTempFile(t, bad)
+		defer os.Remove(fileName)
+		if _, err = ReadSources(fileName); err == nil {
+			t.Fatalf("%v should fail", bad)
+		}
+	}
+}
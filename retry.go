@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"github.com/olomix/dynproxy/proxy_cache"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const ATTEMPTS_HEADER = "X-Dynproxy-Attempts"
+
+// Request body larger than this is not buffered, so request with it is
+// not retried after it was sent to proxy.
+const maxRetryBodySize = 1 << 20
+
+// How many times to ask cache for proxy not tried yet
+const retryPickLimit = 10
+
+// Error on connecting to proxy. Nothing was sent to proxy yet, so request
+// may be retried with another proxy regardless of its method.
+type dialError struct {
+	error
+}
+
+// Proxies tried for one client request
+type attempts struct {
+	forced  bool // proxy forced by client with header, do not change it
+	pool    []string
+	proxies []string
+}
+
+func (a *attempts) add(proxy *proxy_cache.Proxy) {
+	a.proxies = append(a.proxies, proxy.Name())
+}
+
+func (a *attempts) canRetry() bool {
+	return !a.forced && len(a.proxies) < maxAttempts
+}
+
+// Headers to report proxies used to client. Last tried proxy is reported
+// in PROXY_HEADER, full list of proxies goes to ATTEMPTS_HEADER if request
+// was retried.
+func (a *attempts) header() http.Header {
+	var h http.Header = make(http.Header)
+	if len(a.proxies) == 0 {
+		return h
+	}
+	h.Set(PROXY_HEADER, a.proxies[len(a.proxies)-1])
+	if len(a.proxies) > 1 {
+		h.Set(ATTEMPTS_HEADER, strings.Join(a.proxies, ", "))
+	}
+	return h
+}
+
+// Get proxy of pool from cache which was not tried yet for this request.
+// If there is no such proxy, return any of pool.
+func (a *attempts) nextProxy(
+	pCache proxy_cache.ProxyCache,
+) (proxy_cache.Proxy, error) {
+	var (
+		proxy proxy_cache.Proxy
+		err   error
+	)
+	for i := 0; i < retryPickLimit; i++ {
+		if proxy, err = pCache.NextProxyInPool(a.pool); err != nil {
+			return proxy, err
+		}
+		if !a.tried(&proxy) {
+			break
+		}
+	}
+	return proxy, nil
+}
+
+func (a *attempts) tried(proxy *proxy_cache.Proxy) bool {
+	for _, p := range a.proxies {
+		if p == proxy.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Read body of idempotent request into memory, so request may be sent
+// again to another proxy. Return false if request can't be resent.
+func bufferBody(req *http.Request) (bool, error) {
+	if !isIdempotent(req.Method) {
+		return false, nil
+	}
+	if req.Body == nil || req.Body == http.NoBody {
+		return true, nil
+	}
+	if req.ContentLength < 0 || req.ContentLength > maxRetryBodySize {
+		return false, nil
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return false, err
+	}
+	req.GetBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(body)), nil
+	}
+	req.Body, _ = req.GetBody()
+	return true, nil
+}
+
+// Prepare request body to be sent again. Return false if body was
+// already consumed and can't be restored.
+func rewindBody(req *http.Request) bool {
+	if req.Body == nil || req.Body == http.NoBody {
+		return true
+	}
+	if req.GetBody == nil {
+		return false
+	}
+	var err error
+	req.Body, err = req.GetBody()
+	return err == nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"github.com/olomix/dynproxy/log"
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Client connections being served. On shutdown idle keep-alive connections
+// are closed at once and active ones are waited for.
+type connTracker struct {
+	lock    sync.Mutex
+	conns   map[*net.TCPConn]bool // true if waiting for next request
+	closing bool
+	wg      sync.WaitGroup
+}
+
+var connections *connTracker = &connTracker{
+	conns: make(map[*net.TCPConn]bool)}
+
+// Start tracking new connection. Return false if server is shutting down
+// and connection should be closed.
+func (t *connTracker) add(conn *net.TCPConn, idle bool) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[conn] = idle
+	t.wg.Add(1)
+	return true
+}
+
+func (t *connTracker) remove(conn *net.TCPConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.conns[conn]; ok {
+		delete(t.conns, conn)
+		t.wg.Done()
+	}
+}
+
+// Mark connection as waiting for next request. Return false if server is
+// shutting down and connection should be closed instead.
+func (t *connTracker) setIdle(conn *net.TCPConn) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		return false
+	}
+	t.conns[conn] = true
+	return true
+}
+
+// Mark connection as serving request.
+func (t *connTracker) setActive(conn *net.TCPConn) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing && t.conns[conn] {
+		// Request arrived just before shutdown interrupted reading,
+		// serve it to the end.
+		conn.SetReadDeadline(time.Time{})
+	}
+	t.conns[conn] = false
+}
+
+func (t *connTracker) isClosing() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closing
+}
+
+// Stop accepting new connections and close idle ones.
+func (t *connTracker) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.closing = true
+	for conn, idle := range t.conns {
+		if idle {
+			// Interrupt reading of next request
+			conn.SetReadDeadline(time.Now())
+		}
+	}
+}
+
+// Wait for active connections up to timeout. Connections still active
+// after timeout are closed without waiting for their handlers.
+func (t *connTracker) wait(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		t.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	log.Printf("Closing %v active connections", len(t.conns))
+	for conn := range t.conns {
+		conn.Close()
+	}
+}
+
+// Block until process is asked to stop.
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	return <-signals
+}
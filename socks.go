@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/olomix/dynproxy/log"
+	"github.com/olomix/dynproxy/proxy_cache"
+	"github.com/olomix/dynproxy/stats"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SOCKS5 protocol constants, RFC 1928 and RFC 1929
+const (
+	socksVersion     = 5
+	socksAuthVersion = 1
+
+	socksMethodNoAuth       = 0
+	socksMethodUserPass     = 2
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect = 1
+
+	socksAtypIPv4   = 1
+	socksAtypDomain = 3
+	socksAtypIPv6   = 4
+
+	socksRepSuccess          = 0
+	socksRepGeneralFailure   = 1
+	socksRepNotAllowed       = 2
+	socksRepHostUnreachable  = 4
+	socksRepCmdNotSupported  = 7
+	socksRepAtypNotSupported = 8
+)
+
+// Accept SOCKS5 clients and handle each one in separate goroutine.
+func serveSocks(
+	server *net.TCPListener,
+	pCache proxy_cache.ProxyCache,
+	grs *stats.GoRoutineStats,
+) {
+	for {
+		conn, err := server.AcceptTCP()
+		if err != nil {
+			if connections.isClosing() {
+				return
+			}
+			log.Error(err)
+			panic(err)
+		}
+		go handleSocksConnection(conn, pCache, grs)
+	}
+}
+
+// Credentials sent by SOCKS5 client with username/password method
+type socksCredentials struct {
+	username, password string
+}
+
+var errSocksVersion = errors.New("unsupported SOCKS version")
+var errSocksAuthFailed = errors.New("authentication failed")
+
+func handleSocksConnection(
+	clientConn *net.TCPConn,
+	pCache proxy_cache.ProxyCache,
+	grs *stats.GoRoutineStats,
+) {
+	if !connections.add(clientConn, false) {
+		clientConn.Close()
+		return
+	}
+	defer connections.remove(clientConn)
+	defer clientConn.Close()
+
+	var clientReader *bufio.Reader = bufio.NewReader(clientConn)
+	creds, err := socksHandshake(clientConn, clientReader)
+	if err != nil {
+		log.Errorf(
+			"%v: SOCKS handshake failed: %v", clientConn.RemoteAddr(), err)
+		if err == errSocksAuthFailed {
+			traffic := newRequestTraffic(grs, clientConn.RemoteAddr())
+			traffic.fail(errorTypeAuth)
+			traffic.done()
+		}
+		return
+	}
+
+	target, err := socksReadRequest(clientConn, clientReader)
+	if err != nil {
+		log.Errorf(
+			"%v: Can't read SOCKS request: %v", clientConn.RemoteAddr(), err)
+		return
+	}
+
+	requestIdx := grs.NewRequest(clientConn.RemoteAddr().String())
+	defer grs.StopClientHandler(requestIdx)
+	defer func(start time.Time) {
+		requestDuration.Observe(
+			time.Since(start).Seconds(), requestKindSOCKS)
+	}(time.Now())
+	grs.SetUrl(requestIdx, fmt.Sprintf("SOCKS %v", target))
+	var traffic *requestTraffic = newRequestTraffic(
+		grs, clientConn.RemoteAddr())
+	defer traffic.done()
+	var user string
+	if creds != nil && users != nil {
+		user, _ = parseUsername(creds.username)
+		grs.SetUser(requestIdx, user)
+		traffic.setUser(user)
+	}
+
+	policy, ok := policies.Lookup(user)
+	if !ok || !policy.AllowTarget(target) {
+		log.Errorf(
+			"%v: User %q is not allowed to connect to %v",
+			requestIdx, user, target)
+		traffic.fail(errorTypeDenied)
+		socksWriteReply(clientConn, socksRepNotAllowed)
+		return
+	}
+
+	var (
+		proxy     proxy_cache.Proxy
+		proxyConn net.Conn
+		tries     attempts
+	)
+	var opts clientOptions
+	if creds != nil {
+		opts = usernameOptions(creds.username)
+	}
+	if tries.pool, ok = restrictPool(policy, opts.pool); !ok {
+		log.Errorf(
+			"%v: User %q is not allowed to use pool %v",
+			requestIdx, user, strings.Join(opts.pool, ","))
+		traffic.fail(errorTypeDenied)
+		socksWriteReply(clientConn, socksRepNotAllowed)
+		return
+	}
+	if opts.session != "" {
+		proxy, err = pCache.SessionProxy(
+			user, opts.session, tries.pool)
+	} else {
+		proxy, err = pCache.NextProxyInPool(tries.pool)
+	}
+	if err != nil {
+		log.Errorf("%v: Can't get next proxy: %v", requestIdx, err)
+		traffic.fail(errorTypeNoProxy)
+		socksWriteReply(clientConn, socksRepGeneralFailure)
+		return
+	}
+	for {
+		tries.add(&proxy)
+		grs.NewAttempt(requestIdx, proxy.Name())
+		traffic.attempt(proxy.Name())
+		log.Printf(
+			"%v: Handle SOCKS request with %v", requestIdx, proxy.Name())
+
+		pCache.Acquire(proxy.Addr)
+		start := time.Now()
+		proxyConn, err = proxy.DialTunnel(target, proxyDialTimeout)
+		if err == nil {
+			pCache.ReportSuccess(
+				proxy.Addr, proxy_cache.Timing{Connect: time.Since(start)})
+			break
+		}
+		pCache.Release(proxy.Addr)
+		traffic.attemptFailed(err)
+		log.Errorf(
+			"%v: Can't open tunnel with proxy %v: %v",
+			requestIdx, proxy.Name(), err)
+		pCache.ReportFailure(proxy.Addr)
+		if !tries.canRetry() {
+			socksWriteReply(clientConn, socksRepHostUnreachable)
+			return
+		}
+		if proxy, err = tries.nextProxy(pCache); err != nil {
+			log.Errorf("%v: Can't get next proxy: %v", requestIdx, err)
+			socksWriteReply(clientConn, socksRepGeneralFailure)
+			return
+		}
+	}
+	defer proxyConn.Close()
+	defer pCache.Release(proxy.Addr)
+
+	if err = socksWriteReply(clientConn, socksRepSuccess); err != nil {
+		log.Errorf("%v: Error on writing SOCKS reply: %v", requestIdx, err)
+		traffic.fail(errorTypeClient)
+		return
+	}
+
+	in, out := pipeTunnel(
+		clientConn, proxyConn, clientReader, proxyConn, grs, requestIdx)
+	traffic.in += in
+	traffic.out += out
+}
+
+// Negotiate authentication method with client. Prefer username/password
+// if client offers it, as username may carry options. If authentication
+// of clients is enabled, username/password is required and checked.
+// Return credentials if client authenticated with username and password.
+func socksHandshake(
+	clientConn io.Writer, clientReader *bufio.Reader,
+) (*socksCredentials, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(clientReader, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != socksVersion {
+		return nil, errSocksVersion
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(clientReader, methods); err != nil {
+		return nil, err
+	}
+
+	var method byte = socksMethodNoAcceptable
+	for _, m := range methods {
+		if m == socksMethodUserPass {
+			method = m
+			break
+		}
+		if m == socksMethodNoAuth && users == nil {
+			method = m
+		}
+	}
+	if _, err := clientConn.Write([]byte{socksVersion, method}); err != nil {
+		return nil, err
+	}
+
+	switch method {
+	case socksMethodNoAuth:
+		return nil, nil
+	case socksMethodUserPass:
+		creds, err := socksReadCredentials(clientReader)
+		if err != nil {
+			return nil, err
+		}
+		if users != nil {
+			name, _ := parseUsername(creds.username)
+			if !users.Check(name, creds.password) {
+				clientConn.Write([]byte{socksAuthVersion, 1})
+				return nil, errSocksAuthFailed
+			}
+		}
+		_, err = clientConn.Write([]byte{socksAuthVersion, 0})
+		return creds, err
+	default:
+		return nil, errors.New("no acceptable authentication methods")
+	}
+}
+
+func socksReadCredentials(clientReader *bufio.Reader) (*socksCredentials, error) {
+	version, err := clientReader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	if version != socksAuthVersion {
+		return nil, fmt.Errorf("unsupported auth version %d", version)
+	}
+	var creds *socksCredentials = new(socksCredentials)
+	if creds.username, err = socksReadString(clientReader); err != nil {
+		return nil, err
+	}
+	if creds.password, err = socksReadString(clientReader); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// Read string prefixed with one byte length
+func socksReadString(clientReader *bufio.Reader) (string, error) {
+	l, err := clientReader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, l)
+	if _, err = io.ReadFull(clientReader, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+// Read client request and return target address in host:port form. Only
+// CONNECT command is supported, on other commands error is replied to client.
+func socksReadRequest(
+	clientConn io.Writer, clientReader *bufio.Reader,
+) (string, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(clientReader, header[:]); err != nil {
+		return "", err
+	}
+	if header[0] != socksVersion {
+		return "", errSocksVersion
+	}
+	if header[1] != socksCmdConnect {
+		socksWriteReply(clientConn, socksRepCmdNotSupported)
+		return "", fmt.Errorf("unsupported command %d", header[1])
+	}
+
+	var (
+		host string
+		err  error
+	)
+	switch header[3] {
+	case socksAtypIPv4:
+		ip := make(net.IP, net.IPv4len)
+		_, err = io.ReadFull(clientReader, ip)
+		host = ip.String()
+	case socksAtypIPv6:
+		ip := make(net.IP, net.IPv6len)
+		_, err = io.ReadFull(clientReader, ip)
+		host = ip.String()
+	case socksAtypDomain:
+		host, err = socksReadString(clientReader)
+	default:
+		socksWriteReply(clientConn, socksRepAtypNotSupported)
+		return "", fmt.Errorf("unsupported address type %d", header[3])
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var port [2]byte
+	if _, err = io.ReadFull(clientReader, port[:]); err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(
+		host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// Write reply to client request. Bound address is always reported as
+// 0.0.0.0:0 as it has no meaning for tunnel through upstream proxy.
+func socksWriteReply(clientConn io.Writer, rep byte) error {
+	_, err := clientConn.Write(
+		[]byte{socksVersion, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"github.com/olomix/dynproxy/auth"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+)
+
+// Users with alice:secret for tests
+func testUsers(t *testing.T) *auth.Users {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := ioutil.TempFile("", "dynproxy-auth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("alice:" + string(hash) + "\n")
+	f.Close()
+	u, err := auth.ReadHtpasswd(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// Client authentication with username/password method
+func userPass(user, password string) []byte {
+	b := []byte{socksAuthVersion, byte(len(user))}
+	b = append(b, user...)
+	b = append(b, byte(len(password)))
+	return append(b, password...)
+}
+
+func TestSocksHandshake(t *testing.T) {
+	defer func(u *auth.Users) { users = u }(users)
+	alice := testUsers(t)
+
+	cases := []struct {
+		name  string
+		users *auth.Users
+		in    []byte
+		reply []byte
+		user  string // username of returned credentials
+		err   bool
+	}{
+		{
+			name:  "no auth",
+			in:    []byte{5, 1, socksMethodNoAuth},
+			reply: []byte{5, socksMethodNoAuth},
+		},
+		{
+			name:  "no auth refused with users",
+			users: alice,
+			in:    []byte{5, 1, socksMethodNoAuth},
+			reply: []byte{5, socksMethodNoAcceptable},
+			err:   true,
+		},
+		{
+			name:  "user/pass preferred",
+			users: alice,
+			in: append(
+				[]byte{5, 2, socksMethodNoAuth, socksMethodUserPass},
+				userPass("alice", "secret")...),
+			reply: []byte{5, socksMethodUserPass, socksAuthVersion, 0},
+			user:  "alice",
+		},
+		{
+			name:  "user/pass with options",
+			users: alice,
+			in: append(
+				[]byte{5, 1, socksMethodUserPass},
+				userPass("alice?session=1", "secret")...),
+			reply: []byte{5, socksMethodUserPass, socksAuthVersion, 0},
+			user:  "alice?session=1",
+		},
+		{
+			name:  "wrong password",
+			users: alice,
+			in: append(
+				[]byte{5, 1, socksMethodUserPass},
+				userPass("alice", "wrong")...),
+			reply: []byte{5, socksMethodUserPass, socksAuthVersion, 1},
+			err:   true,
+		},
+		{
+			name: "user/pass without users",
+			in: append(
+				[]byte{5, 1, socksMethodUserPass},
+				userPass("bob", "any")...),
+			reply: []byte{5, socksMethodUserPass, socksAuthVersion, 0},
+			user:  "bob",
+		},
+		{
+			name: "bad version",
+			in:   []byte{4, 1, socksMethodNoAuth},
+			err:  true,
+		},
+	}
+	for _, c := range cases {
+		users = c.users
+		var out bytes.Buffer
+		creds, err := socksHandshake(
+			&out, bufio.NewReader(bytes.NewReader(c.in)))
+		if (err != nil) != c.err {
+			t.Fatalf("%v: unexpected error %v", c.name, err)
+		}
+		if !bytes.Equal(out.Bytes(), c.reply) {
+			t.Fatalf("%v: replied %v, expected %v", c.name, out.Bytes(), c.reply)
+		}
+		var user string
+		if creds != nil {
+			user = creds.username
+		}
+		if user != c.user {
+			t.Fatalf("%v: got user %q, expected %q", c.name, user, c.user)
+		}
+	}
+}
+
+func TestSocksReadRequest(t *testing.T) {
+	// Reply with error code and zero bound address
+	failure := func(rep byte) []byte {
+		return []byte{5, rep, 0, socksAtypIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	cases := []struct {
+		name   string
+		in     []byte
+		target string
+		reply  []byte // written on error only
+		err    bool
+	}{
+		{
+			name:   "ipv4",
+			in:     []byte{5, socksCmdConnect, 0, socksAtypIPv4, 1, 2, 3, 4, 0, 80},
+			target: "1.2.3.4:80",
+		},
+		{
+			name: "ipv6",
+			in: append(append(
+				[]byte{5, socksCmdConnect, 0, socksAtypIPv6},
+				net.ParseIP("::1")...), 1, 187),
+			target: "[::1]:443",
+		},
+		{
+			name: "domain",
+			in: append(append(
+				[]byte{5, socksCmdConnect, 0, socksAtypDomain, 11},
+				"example.com"...), 1, 187),
+			target: "example.com:443",
+		},
+		{
+			name:  "unknown address type",
+			in:    []byte{5, socksCmdConnect, 0, 9, 1, 2, 3, 4, 0, 80},
+			reply: failure(socksRepAtypNotSupported),
+			err:   true,
+		},
+		{
+			name:  "bind command",
+			in:    []byte{5, 2, 0, socksAtypIPv4, 1, 2, 3, 4, 0, 80},
+			reply: failure(socksRepCmdNotSupported),
+			err:   true,
+		},
+		{
+			name: "bad version",
+			in:   []byte{4, socksCmdConnect, 0, socksAtypIPv4, 1, 2, 3, 4, 0, 80},
+			err:  true,
+		},
+		{
+			name: "truncated",
+			in:   []byte{5, socksCmdConnect, 0, socksAtypIPv4, 1, 2},
+			err:  true,
+		},
+	}
+	for _, c := range cases {
+		var out bytes.Buffer
+		target, err := socksReadRequest(
+			&out, bufio.NewReader(bytes.NewReader(c.in)))
+		if (err != nil) != c.err || target != c.target {
+			t.Fatalf("%v: got %q, %v", c.name, target, err)
+		}
+		if !bytes.Equal(out.Bytes(), c.reply) {
+			t.Fatalf("%v: replied %v, expected %v", c.name, out.Bytes(), c.reply)
+		}
+	}
+}
@@ -18,9 +18,10 @@ func (i RequestIdx) String() string {
 }
 
 type Request struct {
-	URL, Client, Proxy                        string
+	URL, Client, Proxy, User                  string
 	ClientHandlerRunning, ProxyHandlerRunning bool
 	Start                                     time.Time
+	Attempts                                  int
 }
 
 type GoRoutineStats struct {
@@ -30,6 +31,9 @@ type GoRoutineStats struct {
 	lock           sync.Mutex
 	requests       []Request
 	requestsMask   []bool // If false, then appropriate element in requests is free
+	trafficLock    sync.Mutex
+	proxyTraffic   trafficTable
+	clientTraffic  trafficTable
 }
 
 func New() *GoRoutineStats {
@@ -113,6 +117,9 @@ func (grs *GoRoutineStats) NewRequest(client string) RequestIdx {
 	grs.requests[idx].ClientHandlerRunning = true
 	grs.requests[idx].ProxyHandlerRunning = false
 	grs.requests[idx].Start = time.Now()
+	grs.requests[idx].Proxy = ""
+	grs.requests[idx].Attempts = 0
+	grs.requests[idx].User = ""
 
 	var ri RequestIdx = RequestIdx{idx: idx, wg: new(sync.WaitGroup)}
 	ri.wg.Add(1)
@@ -137,6 +144,21 @@ func (grs *GoRoutineStats) SetProxy(idx RequestIdx, proxy string) {
 	grs.lock.Unlock()
 }
 
+// Set name of authenticated client user
+func (grs *GoRoutineStats) SetUser(idx RequestIdx, user string) {
+	grs.lock.Lock()
+	grs.requests[idx.idx].User = user
+	grs.lock.Unlock()
+}
+
+// Record new attempt to serve request with proxy
+func (grs *GoRoutineStats) NewAttempt(idx RequestIdx, proxy string) {
+	grs.lock.Lock()
+	grs.requests[idx.idx].Proxy = proxy
+	grs.requests[idx.idx].Attempts++
+	grs.lock.Unlock()
+}
+
 func (grs *GoRoutineStats) StartProxyHandler(idx RequestIdx) {
 	grs.lock.Lock()
 	grs.requests[idx.idx].ProxyHandlerRunning = true
@@ -166,9 +188,10 @@ func (grs *GoRoutineStats) StopClientHandler(idx RequestIdx) {
 
 type ActiveRequest struct {
 	Idx                                       int
-	URL, Client, Proxy                        string
+	URL, Client, Proxy, User                  string
 	ClientHandlerRunning, ProxyHandlerRunning bool
 	ActiveSeconds                             int
+	Attempts                                  int
 }
 
 func (grs *GoRoutineStats) ActiveRequests() []ActiveRequest {
@@ -189,9 +212,11 @@ func (grs *GoRoutineStats) ActiveRequests() []ActiveRequest {
 			URL:                  grs.requests[idx].URL,
 			Client:               grs.requests[idx].Client,
 			Proxy:                grs.requests[idx].Proxy,
+			User:                 grs.requests[idx].User,
 			ClientHandlerRunning: grs.requests[idx].ClientHandlerRunning,
 			ProxyHandlerRunning:  grs.requests[idx].ProxyHandlerRunning,
 			ActiveSeconds:        int(time.Since(grs.requests[idx].Start).Seconds()),
+			Attempts:             grs.requests[idx].Attempts,
 		})
 	}
 	grs.lock.Unlock()
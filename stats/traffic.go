@@ -0,0 +1,141 @@
+package stats
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+// Traffic counters of one proxy or one client
+type Traffic struct {
+	Requests uint64
+	BytesIn  uint64            // from proxy to client
+	BytesOut uint64            // from client to proxy
+	Status   map[string]uint64 // replies by status class like "2xx"
+	Errors   map[string]uint64 // failed requests by error type
+}
+
+// Counters of one request: its bytes, status of reply if any and type of
+// error if request failed.
+func RequestTraffic(in, out int64, status int, errType string) Traffic {
+	var t Traffic = Traffic{
+		Requests: 1, BytesIn: uint64(in), BytesOut: uint64(out)}
+	if status > 0 {
+		t.Status = map[string]uint64{StatusClass(status): 1}
+	}
+	if errType != "" {
+		t.Errors = map[string]uint64{errType: 1}
+	}
+	return t
+}
+
+// Class of HTTP status like "2xx"
+func StatusClass(status int) string {
+	return fmt.Sprintf("%dxx", status/100)
+}
+
+func (t *Traffic) add(d Traffic) {
+	t.Requests += d.Requests
+	t.BytesIn += d.BytesIn
+	t.BytesOut += d.BytesOut
+	t.Status = addCounts(t.Status, d.Status)
+	t.Errors = addCounts(t.Errors, d.Errors)
+}
+
+func addCounts(to, from map[string]uint64) map[string]uint64 {
+	if len(from) == 0 {
+		return to
+	}
+	if to == nil {
+		to = make(map[string]uint64, len(from))
+	}
+	for k, v := range from {
+		to[k] += v
+	}
+	return to
+}
+
+// Traffic by proxy name or by client
+type trafficTable map[string]*Traffic
+
+func (tt trafficTable) add(key string, d Traffic) trafficTable {
+	if tt == nil {
+		tt = make(trafficTable)
+	}
+	t, ok := tt[key]
+	if !ok {
+		t = new(Traffic)
+		tt[key] = t
+	}
+	t.add(d)
+	return tt
+}
+
+func (tt trafficTable) copy() map[string]Traffic {
+	var result map[string]Traffic = make(map[string]Traffic, len(tt))
+	for key, t := range tt {
+		var c Traffic
+		c.add(*t)
+		result[key] = c
+	}
+	return result
+}
+
+// Add traffic of request through proxy
+func (grs *GoRoutineStats) AddProxyTraffic(proxy string, d Traffic) {
+	grs.trafficLock.Lock()
+	grs.proxyTraffic = grs.proxyTraffic.add(proxy, d)
+	grs.trafficLock.Unlock()
+}
+
+// Add traffic of client request. Client is user name if client is
+// authenticated or its IP otherwise.
+func (grs *GoRoutineStats) AddClientTraffic(client string, d Traffic) {
+	grs.trafficLock.Lock()
+	grs.clientTraffic = grs.clientTraffic.add(client, d)
+	grs.trafficLock.Unlock()
+}
+
+// Copy of traffic counters by proxy name
+func (grs *GoRoutineStats) ProxyTraffic() map[string]Traffic {
+	grs.trafficLock.Lock()
+	defer grs.trafficLock.Unlock()
+	return grs.proxyTraffic.copy()
+}
+
+// Copy of traffic counters by client
+func (grs *GoRoutineStats) ClientTraffic() map[string]Traffic {
+	grs.trafficLock.Lock()
+	defer grs.trafficLock.Unlock()
+	return grs.clientTraffic.copy()
+}
+
+// Traffic counters as written to save file
+type savedTraffic struct {
+	Proxies map[string]Traffic
+	Clients map[string]Traffic
+}
+
+// Write all traffic counters to w
+func (grs *GoRoutineStats) SaveTraffic(w io.Writer) error {
+	return gob.NewEncoder(w).Encode(savedTraffic{
+		Proxies: grs.ProxyTraffic(),
+		Clients: grs.ClientTraffic(),
+	})
+}
+
+// Read traffic counters written by SaveTraffic and add them to current
+// ones.
+func (grs *GoRoutineStats) LoadTraffic(r io.Reader) error {
+	var saved savedTraffic
+	if err := gob.NewDecoder(r).Decode(&saved); err != nil {
+		return err
+	}
+	for proxy, t := range saved.Proxies {
+		grs.AddProxyTraffic(proxy, t)
+	}
+	for client, t := range saved.Clients {
+		grs.AddClientTraffic(client, t)
+	}
+	return nil
+}
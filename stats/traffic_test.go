@@ -0,0 +1,52 @@
+package stats
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestTraffic(t *testing.T) {
+	grs := New()
+	grs.AddProxyTraffic("1.1.1.1:80", RequestTraffic(100, 10, 200, ""))
+	grs.AddProxyTraffic("1.1.1.1:80", RequestTraffic(50, 5, 502, ""))
+	grs.AddProxyTraffic("2.2.2.2:80", RequestTraffic(0, 0, 0, "dial"))
+	grs.AddClientTraffic("user", RequestTraffic(150, 15, 200, "dial"))
+
+	traffic := grs.ProxyTraffic()
+	expected := Traffic{
+		Requests: 2, BytesIn: 150, BytesOut: 15,
+		Status: map[string]uint64{"2xx": 1, "5xx": 1}}
+	if !reflect.DeepEqual(traffic["1.1.1.1:80"], expected) {
+		t.Fatalf("unexpected traffic %+v", traffic["1.1.1.1:80"])
+	}
+	if traffic["2.2.2.2:80"].Errors["dial"] != 1 {
+		t.Fatalf("unexpected traffic %+v", traffic["2.2.2.2:80"])
+	}
+
+	// returned counters are copies
+	traffic["1.1.1.1:80"].Status["2xx"] = 10
+	if grs.ProxyTraffic()["1.1.1.1:80"].Status["2xx"] != 1 {
+		t.Fatal("traffic changed through copy")
+	}
+
+	var buf bytes.Buffer
+	if err := grs.SaveTraffic(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded := New()
+	loaded.AddClientTraffic("user", RequestTraffic(1, 1, 404, ""))
+	if err := loaded.LoadTraffic(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(loaded.ProxyTraffic(), grs.ProxyTraffic()) {
+		t.Fatalf("unexpected loaded traffic %+v", loaded.ProxyTraffic())
+	}
+	expected = Traffic{
+		Requests: 2, BytesIn: 151, BytesOut: 16,
+		Status: map[string]uint64{"2xx": 1, "4xx": 1},
+		Errors: map[string]uint64{"dial": 1}}
+	if !reflect.DeepEqual(loaded.ClientTraffic()["user"], expected) {
+		t.Fatalf("unexpected loaded traffic %+v", loaded.ClientTraffic())
+	}
+}
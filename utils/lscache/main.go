@@ -3,10 +3,15 @@ package main
 import (
 	"fmt"
 	"github.com/olomix/dynproxy/proxy_cache"
+	"os"
 )
 
 func main() {
-	proxyList := proxy_cache.LoadCache()
+	proxyList, err := proxy_cache.LoadCache(proxy_cache.AutoSaveFilename)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 	for i := range proxyList {
 		fmt.Println(proxyList[i].String())
 	}